@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// maxRequestBody limits the size of json bodies accepted by the web api
+const maxRequestBody = 1 << 20
+
+// apiError is the json body returned by the web api when a request fails
+type apiError struct {
+	Error string `json:"Error"`
+}
+
+// statusForError maps the errors returned when validating and storing hosts and networks on to http status codes
+func statusForError(err error) int {
+	switch err.(type) {
+	case ValidationError:
+		return http.StatusUnprocessableEntity
+	case ConflictError:
+		return http.StatusConflict
+	case ForbiddenError:
+		return http.StatusForbidden
+	}
+	if err == ErrNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// writeJSON writes v as the json body of a response, a nil v writes only the status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	if v == nil {
+		w.WriteHeader(status)
+		return
+	}
+	c, err := json.Marshal(v)
+	if showerror("cannot marshal json", err, "warn") {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s", c)
+}
+
+// writeJSONError writes err as a json error body with the matching status code
+func writeJSONError(w http.ResponseWriter, err error) {
+	status := statusForError(err)
+	if status == http.StatusInternalServerError {
+		showerror("web api request failed", err, "warn")
+	}
+	writeJSON(w, status, apiError{err.Error()})
+}
+
+// readJSONBody reads the body of a request and returns the names of the top level fields it sets
+func readJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) (map[string]json.RawMessage, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	return fields, json.Unmarshal(body, v)
+}
+
+// hostLocation returns the url of a host within the web api
+func hostLocation(host Host) string {
+	return "/host/" + url.PathEscape(host.Hostname) + "?network=" + url.QueryEscape(host.Network)
+}
+
+// findRequestHost finds the host addressed by /host/{host}, the network query is needed when
+// the fqdn is used within more than one network
+func findRequestHost(r *http.Request) (Host, error) {
+	fqdn := mux.Vars(r)["host"]
+	network, ok := restrictNetwork(r, r.URL.Query().Get("network"))
+	if !ok {
+		return Host{}, errForbidden
+	}
+	myhosts, err := store.ListHosts(HostFilter{FQDN: fqdn, Network: network})
+	if err != nil {
+		return Host{}, err
+	}
+	if len(myhosts) == 0 {
+		return Host{}, ErrNotFound
+	}
+	if len(myhosts) > 1 {
+		return Host{}, ConflictError{fqdn + " exists in more than one network, pass ?network= to pick one"}
+	}
+	return myhosts[0], nil
+}
+
+// findRequestNetwork returns the network named in the url. A token restricted to another network is refused
+// before the lookup, so it cannot tell which networks exist
+func findRequestNetwork(r *http.Request) (SingleNetwork, error) {
+	name := mux.Vars(r)["network"]
+	if !requestAllowsNetwork(r, name) {
+		return SingleNetwork{}, errForbidden
+	}
+	return store.GetNetwork(name)
+}
+
+// saveHost validates and stores a host, original is nil when the host is new. Changing the status
+// of a host is the same as approving it, so needs the admin scope
+func saveHost(r *http.Request, host Host, original *Host) (Host, error) {
+	if !requestAllowsNetwork(r, host.Network) {
+		return Host{}, errForbidden
+	}
+	if original != nil && host.Status != "" && host.Status != original.Status && !requestIsAdmin(r) {
+		return Host{}, errNotAdmin
+	}
+	if original == nil {
+		return addHost(requestAudit(r, nil), host)
+	}
+	return updateHost(requestAudit(r, nil), original.Hostname, original.Network, host)
+}
+
+func handlerCreateHost(w http.ResponseWriter, r *http.Request) {
+	var host Host
+	if _, err := readJSONBody(w, r, &host); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"invalid json body: " + err.Error()})
+		return
+	}
+	created, err := saveHost(r, host, nil)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	w.Header().Set("Location", hostLocation(created))
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// handlerReplaceHost handles PUT, the body replaces the whole host. A blank fqdn, network or status keeps the current one
+func handlerReplaceHost(w http.ResponseWriter, r *http.Request) {
+	original, err := findRequestHost(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	var host Host
+	if _, err := readJSONBody(w, r, &host); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"invalid json body: " + err.Error()})
+		return
+	}
+	if host.Hostname == "" {
+		host.Hostname = original.Hostname
+	}
+	if host.Network == "" {
+		host.Network = original.Network
+	}
+	updated, err := saveHost(r, host, &original)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// handlerPatchHost handles PATCH, only the fields within the body are changed
+func handlerPatchHost(w http.ResponseWriter, r *http.Request) {
+	original, err := findRequestHost(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	host := original
+	host.Aliases = append([]string{}, original.Aliases...)
+	fields, err := readJSONBody(w, r, &host)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"invalid json body: " + err.Error()})
+		return
+	}
+	if _, ok := fields["Aliases"]; ok {
+		// Aliases wins over Short1..Short4, so the current shorts must not bring back removed aliases
+		host.Short1, host.Short2, host.Short3, host.Short4 = "", "", "", ""
+	} else {
+		host.Aliases = mergeAliases(original.Aliases, host.Short1, host.Short2, host.Short3, host.Short4)
+	}
+	updated, err := saveHost(r, host, &original)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func handlerDeleteHost(w http.ResponseWriter, r *http.Request) {
+	host, err := findRequestHost(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if err := delHost(requestAudit(r, nil), host.Hostname, host.Network); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+// saveNetwork validates and stores a network, original is nil when the network is new
+func saveNetwork(r *http.Request, network SingleNetwork, original *SingleNetwork) (SingleNetwork, error) {
+	if !requestAllowsNetwork(r, network.Network) || (original != nil && !requestAllowsNetwork(r, original.Network)) {
+		return SingleNetwork{}, errForbidden
+	}
+	if original == nil {
+		return addNetwork(requestAudit(r, nil), network)
+	}
+	return updateNetwork(requestAudit(r, nil), original.Network, network)
+}
+
+func handlerCreateNetwork(w http.ResponseWriter, r *http.Request) {
+	var network SingleNetwork
+	if _, err := readJSONBody(w, r, &network); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"invalid json body: " + err.Error()})
+		return
+	}
+	created, err := saveNetwork(r, network, nil)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/network/"+url.PathEscape(created.Network))
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// handlerReplaceNetwork handles PUT, the body replaces the whole network. A blank network keeps the current name
+func handlerReplaceNetwork(w http.ResponseWriter, r *http.Request) {
+	original, err := findRequestNetwork(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	var network SingleNetwork
+	if _, err := readJSONBody(w, r, &network); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"invalid json body: " + err.Error()})
+		return
+	}
+	if network.Network == "" {
+		network.Network = original.Network
+	}
+	updated, err := saveNetwork(r, network, &original)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// handlerPatchNetwork handles PATCH, only the fields within the body are changed
+func handlerPatchNetwork(w http.ResponseWriter, r *http.Request) {
+	original, err := findRequestNetwork(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	network := original
+	if _, err := readJSONBody(w, r, &network); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"invalid json body: " + err.Error()})
+		return
+	}
+	updated, err := saveNetwork(r, network, &original)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func handlerDeleteNetwork(w http.ResponseWriter, r *http.Request) {
+	network, err := findRequestNetwork(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if err := delNetwork(requestAudit(r, nil), network.Network); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
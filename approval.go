@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"net/http"
+	"strings"
+)
+
+// statuses of a host, pending hosts were registered by a device and are hidden until approved
+const (
+	hostActive  = "active"
+	hostPending = "pending"
+)
+
+// errNotAdmin is returned when a web request without the admin scope tries to approve a host
+var errNotAdmin = ForbiddenError{"only api tokens with the admin scope can approve or reject hosts"}
+
+// registrationStatus returns the status of a host newly registered in to network
+func registrationStatus(network string) (string, error) {
+	mynetwork, err := store.GetNetwork(network)
+	if err == ErrNotFound {
+		// validating the host reports the missing network
+		return hostPending, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if mynetwork.AutoApprove {
+		return hostActive, nil
+	}
+	return hostPending, nil
+}
+
+// findPendingHost returns a host that is waiting for approval
+func findPendingHost(fqdn string, network string) (Host, error) {
+	host, err := store.GetHost(fqdn, network)
+	if err != nil {
+		return Host{}, err
+	}
+	if host.Status != hostPending {
+		return Host{}, ConflictError{"host is not pending approval: " + host.Hostname + " / " + host.Network}
+	}
+	return host, nil
+}
+
+// approveHost makes a pending host active, returning the host as stored
+func approveHost(audit auditContext, fqdn string, network string) (Host, error) {
+	host, err := findPendingHost(fqdn, network)
+	if err != nil {
+		return Host{}, err
+	}
+	host.Status = hostActive
+	return updateHost(audit.as(auditApprove), host.Hostname, host.Network, host)
+}
+
+// rejectHost deletes a pending host
+func rejectHost(audit auditContext, fqdn string, network string) error {
+	host, err := findPendingHost(fqdn, network)
+	if err != nil {
+		return err
+	}
+	return delHost(audit.as(auditReject), host.Hostname, host.Network)
+}
+
+// listPendingHosts prints the hosts waiting for approval, within network if one is given
+func listPendingHosts(network string, printjson bool) error {
+	myhosts, err := store.ListHosts(HostFilter{Network: network, Status: hostPending})
+	if err != nil {
+		return err
+	}
+	if printjson {
+		if myhosts == nil {
+			myhosts = []Host{}
+		}
+		c, err := json.Marshal(myhosts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", c)
+		return nil
+	}
+	for _, host := range myhosts {
+		fmt.Printf("%-15s  %-15s  %-17s  %s  %s\n", host.Network, host.IPv4, host.MAC, host.Hostname, strings.Join(host.Aliases, "  "))
+	}
+	return nil
+}
+
+// requestIsAdmin reports whether a web request can approve and reject hosts
+func requestIsAdmin(r *http.Request) bool {
+	if !viper.GetBool("RequireToken") {
+		return true
+	}
+	token, ok := requestToken(r)
+	return ok && token.HasScope("admin")
+}
+
+// requestHostStatus returns the status filter asked for by the pending query of a web request
+func requestHostStatus(r *http.Request) string {
+	if strings.ToLower(r.URL.Query().Get("pending")) == "y" {
+		return hostPending
+	}
+	return hostActive
+}
+
+// handlerApproveHost handles POST /host/{host}/approve
+func handlerApproveHost(w http.ResponseWriter, r *http.Request) {
+	host, err := findRequestHost(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	approved, err := approveHost(requestAudit(r, nil), host.Hostname, host.Network)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, approved)
+}
+
+// handlerRejectHost handles POST /host/{host}/reject, the pending host is deleted
+func handlerRejectHost(w http.ResponseWriter, r *http.Request) {
+	host, err := findRequestHost(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if err := rejectHost(requestAudit(r, nil), host.Hostname, host.Network); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// actions recorded in the audit log
+const (
+	auditAddHost       = "addhost"
+	auditUpdateHost    = "updatehost"
+	auditDelHost       = "delhost"
+	auditAddNetwork    = "addnetwork"
+	auditUpdateNetwork = "updatenetwork"
+	auditDelNetwork    = "delnetwork"
+	auditRegister      = "register"
+	auditApprove       = "approve"
+	auditReject        = "reject"
+	auditRestore       = "restore"
+)
+
+// AuditEntry is a change recorded in the audit log. Before and After hold the json of the host or network
+// before and after the change, Before is empty when it was added and After is empty when it was deleted
+type AuditEntry struct {
+	ID       int64           `json:"ID"`
+	Time     string          `json:"Time"`
+	Actor    string          `json:"Actor"`
+	SourceIP string          `json:"SourceIP"`
+	Action   string          `json:"Action"`
+	Network  string          `json:"Network"`
+	Hostname string          `json:"Hostname"`
+	Before   json.RawMessage `json:"Before"`
+	After    json.RawMessage `json:"After"`
+}
+
+// auditContext is who is making a change and where from. Action is blank unless the change is part of a
+// registration, approval or rejection, which is then recorded in place of the addhost, updatehost or delhost
+type auditContext struct {
+	Actor    string
+	SourceIP string
+	Action   string
+}
+
+// as returns the context recording changes as action, unless it already records them as something else
+func (a auditContext) as(action string) auditContext {
+	if a.Action == "" {
+		a.Action = action
+	}
+	return a
+}
+
+// cliAudit returns the context of changes made from the command line, the actor is the user running narcotk-hosts
+func cliAudit() auditContext {
+	name := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	if name == "" {
+		name = "unknown"
+	}
+	return auditContext{Actor: "cli:" + name}
+}
+
+// requestAudit returns the context of changes made by a web request, the actor is the api token or registration
+// key it used. A nil key on a registration without a token means the global RegistrationKey was used
+func requestAudit(r *http.Request, key *RegistrationKey) auditContext {
+	audit := auditContext{Actor: "web", SourceIP: remoteIP(r)}
+	if token, ok := requestToken(r); ok {
+		audit.Actor = "token:" + token.Name
+	} else if key != nil {
+		audit.Actor = "regkey:" + key.Name
+	} else if r.URL.Path == "/register" {
+		audit.Actor = "registrationkey"
+	}
+	return audit
+}
+
+// newAuditEntry returns an audit log entry of a change made now
+func newAuditEntry(audit auditContext, action string) AuditEntry {
+	entry := AuditEntry{Time: time.Now().UTC().Format(time.RFC3339), Actor: audit.Actor, SourceIP: audit.SourceIP, Action: action}
+	if audit.Action != "" {
+		entry.Action = audit.Action
+	}
+	return entry
+}
+
+// recordHostChange adds an entry to the audit log for a host, before is nil when it was added and after is nil
+// when it was deleted. The entry is named after the host as it ends up
+func recordHostChange(txstore Store, audit auditContext, action string, before *Host, after *Host) error {
+	entry := newAuditEntry(audit, action)
+	var err error
+	if before != nil {
+		entry.Network, entry.Hostname = before.Network, before.Hostname
+		if entry.Before, err = json.Marshal(before); err != nil {
+			return err
+		}
+	}
+	if after != nil {
+		entry.Network, entry.Hostname = after.Network, after.Hostname
+		if entry.After, err = json.Marshal(after); err != nil {
+			return err
+		}
+	}
+	return txstore.CreateAuditEntry(entry)
+}
+
+// recordNetworkChange adds an entry to the audit log for a network, before is nil when it was added and after is
+// nil when it was deleted
+func recordNetworkChange(txstore Store, audit auditContext, action string, before *SingleNetwork, after *SingleNetwork) error {
+	entry := newAuditEntry(audit, action)
+	var err error
+	if before != nil {
+		entry.Network = before.Network
+		if entry.Before, err = json.Marshal(before); err != nil {
+			return err
+		}
+	}
+	if after != nil {
+		entry.Network = after.Network
+		if entry.After, err = json.Marshal(after); err != nil {
+			return err
+		}
+	}
+	return txstore.CreateAuditEntry(entry)
+}
+
+// auditChanges describes the fields that differ between the before and after of an entry, like "MAC a -> b"
+func auditChanges(entry AuditEntry) string {
+	if entry.Before == nil || entry.After == nil {
+		return ""
+	}
+	var before, after map[string]interface{}
+	if json.Unmarshal(entry.Before, &before) != nil || json.Unmarshal(entry.After, &after) != nil {
+		return ""
+	}
+	var fields []string
+	for field := range after {
+		// padded and short fields only follow the ip address, network and aliases
+		if !strings.HasPrefix(field, "Padded") && !strings.HasPrefix(field, "Short") && !reflect.DeepEqual(before[field], after[field]) {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	var changes []string
+	for _, field := range fields {
+		changes = append(changes, fmt.Sprintf("%s %v -> %v", field, auditValue(before[field]), auditValue(after[field])))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// auditValue formats a json value for auditChanges, lists are separated by spaces
+func auditValue(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		var values []string
+		for _, v := range list {
+			values = append(values, fmt.Sprint(v))
+		}
+		return strings.Join(values, " ")
+	}
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// printHistory prints the audit log newest first, only the entries for a host or network if one is given
+func printHistory(fqdn string, network string, printjson bool) error {
+	entries, err := store.ListAuditEntries(AuditFilter{FQDN: fqdn, Network: network})
+	if err != nil {
+		return err
+	}
+	if printjson {
+		if entries == nil {
+			entries = []AuditEntry{}
+		}
+		c, err := json.Marshal(entries)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", c)
+		return nil
+	}
+	for _, entry := range entries {
+		name := entry.Network
+		if entry.Hostname != "" {
+			name = entry.Hostname + " / " + entry.Network
+		}
+		line := fmt.Sprintf("%s  %-13s  %-20s  %-15s  %s", entry.Time, entry.Action, entry.Actor, entry.SourceIP, name)
+		if changes := auditChanges(entry); changes != "" {
+			line = line + "  (" + changes + ")"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// handlerHistory handles GET /history, ?host= and ?network= narrow down the entries returned
+func handlerHistory(w http.ResponseWriter, r *http.Request) {
+	network, ok := restrictNetwork(r, r.URL.Query().Get("network"))
+	if !ok {
+		writeJSONError(w, errForbidden)
+		return
+	}
+	entries, err := store.ListAuditEntries(AuditFilter{FQDN: r.URL.Query().Get("host"), Network: network})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
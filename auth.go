@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tokenScopes lists the scopes an api token can be given. admin allows everything and write also allows read
+var tokenScopes = []string{"read", "write", "register", "admin"}
+
+// errForbidden is returned when an api token is not allowed to use a network
+var errForbidden = ForbiddenError{"api token is not allowed to use this network"}
+
+// APIToken is a bearer token allowed to use the web api, only a hash of the token itself is stored
+type APIToken struct {
+	Name    string   `json:"Name"`
+	Hash    string   `json:"-"`
+	Scopes  []string `json:"Scopes"`
+	Network string   `json:"Network"`
+	Expires string   `json:"Expires"`
+	Created string   `json:"Created"`
+}
+
+type contextKey string
+
+// tokenContextKey holds the APIToken used to authenticate a web request
+const tokenContextKey contextKey = "token"
+
+// HasScope reports whether a token allows requests that need scope
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == "admin" || (s == "write" && scope == "read") {
+			return true
+		}
+	}
+	return false
+}
+
+// expired reports whether an RFC3339 expiry has passed, a blank expiry never expires
+func expired(expires string, now time.Time) bool {
+	if expires == "" {
+		return false
+	}
+	expiry, err := time.Parse(time.RFC3339, expires)
+	return err != nil || now.After(expiry)
+}
+
+// Expired reports whether a token has passed its expiry, tokens without an expiry never expire
+func (t APIToken) Expired(now time.Time) bool {
+	return expired(t.Expires, now)
+}
+
+// AllowsNetwork reports whether a token can be used with a network, tokens without a network can use them all
+func (t APIToken) AllowsNetwork(network string) bool {
+	return t.Network == "" || strings.EqualFold(t.Network, network)
+}
+
+// splitScopes turns a comma separated list of scopes in to a slice
+func splitScopes(scopes string) []string {
+	var myscopes []string
+	for _, scope := range strings.Split(scopes, ",") {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if scope != "" {
+			myscopes = append(myscopes, scope)
+		}
+	}
+	return myscopes
+}
+
+// checkScopes makes sure at least one scope is given and that all of them are known
+func checkScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required, use: " + strings.Join(tokenScopes, ", "))
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, tokenscope := range tokenScopes {
+			if scope == tokenscope {
+				known = true
+			}
+		}
+		if !known {
+			return errors.New("unknown scope " + scope + ", use: " + strings.Join(tokenScopes, ", "))
+		}
+	}
+	return nil
+}
+
+// parseExpiry turns an expiry given on the command line in to an RFC3339 time, it can be a duration
+// like 720h or 30d, a date like 2019-01-31 or an RFC3339 time. A blank expiry never expires
+func parseExpiry(expires string, now time.Time) (string, error) {
+	if expires == "" {
+		return "", nil
+	}
+	if strings.HasSuffix(expires, "d") {
+		var days int
+		if _, err := fmt.Sscanf(expires, "%dd", &days); err == nil && days > 0 {
+			return now.AddDate(0, 0, days).UTC().Format(time.RFC3339), nil
+		}
+	}
+	if duration, err := time.ParseDuration(expires); err == nil && duration > 0 {
+		return now.Add(duration).UTC().Format(time.RFC3339), nil
+	}
+	if date, err := time.Parse("2006-01-02", expires); err == nil {
+		return date.UTC().Format(time.RFC3339), nil
+	}
+	if date, err := time.Parse(time.RFC3339, expires); err == nil {
+		return date.UTC().Format(time.RFC3339), nil
+	}
+	return "", errors.New("invalid expiry " + expires + ", use a duration like 720h or 30d, or a date like 2019-01-31")
+}
+
+// hashToken returns the hash of a token as stored in the database
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateToken returns a new random token
+func generateToken() (string, error) {
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+// authenticate finds the api token passed in an Authorization: Bearer header
+func authenticate(header string) (APIToken, error) {
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return APIToken{}, errors.New("no bearer token passed")
+	}
+	token, err := store.GetTokenByHash(hashToken(strings.TrimSpace(header[7:])))
+	if err == ErrNotFound {
+		return APIToken{}, errors.New("unknown token")
+	}
+	if err != nil {
+		return APIToken{}, err
+	}
+	if token.Expired(time.Now()) {
+		return APIToken{}, errors.New("token " + token.Name + " expired at " + token.Expires)
+	}
+	return token, nil
+}
+
+// requiredScope works out which scope a web request needs
+func requiredScope(r *http.Request) string {
+	if r.URL.Path == "/register" {
+		return "register"
+	}
+	// the history shows who made every change, so is kept to admins
+	if r.URL.Path == "/history" {
+		return "admin"
+	}
+	// approving and rejecting hosts is done through /host/{host}/approve and /host/{host}/reject
+	if parts := strings.Split(r.URL.Path, "/"); len(parts) == 4 && parts[1] == "host" && (parts[3] == "approve" || parts[3] == "reject") {
+		return "admin"
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return "read"
+	}
+	return "write"
+}
+
+// authMiddleware makes sure requests carry an api token with the scope they need when RequireToken is set.
+// Registrations without a token are passed through so they can still use a registration key
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !viper.GetBool("RequireToken") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scope := requiredScope(r)
+		header := r.Header.Get("Authorization")
+		if header == "" && scope == "register" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, err := authenticate(header)
+		if err != nil {
+			showerror("api token rejected", err, "warn")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="narcotk-hosts"`)
+			writeJSON(w, http.StatusUnauthorized, apiError{"a valid api token is required"})
+			return
+		}
+		if !token.HasScope(scope) {
+			showerror("api token lacks scope "+scope, errors.New(token.Name), "warn")
+			writeJSON(w, http.StatusForbidden, apiError{"api token " + token.Name + " does not have the " + scope + " scope"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey, token)))
+	})
+}
+
+// requestToken returns the api token a web request was authenticated with
+func requestToken(r *http.Request) (APIToken, bool) {
+	token, ok := r.Context().Value(tokenContextKey).(APIToken)
+	return token, ok
+}
+
+// tokenNetwork returns the network the api token of a web request is restricted to, or blank when it is not.
+// Lookups that accept like patterns match the network of a restricted token exactly
+func tokenNetwork(r *http.Request) string {
+	token, _ := requestToken(r)
+	return token.Network
+}
+
+// restrictNetwork narrows a requested network to the network of the request's api token, a blank network
+// becomes the token's network. false is returned when the token cannot use the requested network
+func restrictNetwork(r *http.Request, network string) (string, bool) {
+	token, ok := requestToken(r)
+	if !ok || token.Network == "" {
+		return network, true
+	}
+	if network == "" {
+		return token.Network, true
+	}
+	return network, token.AllowsNetwork(network)
+}
+
+// requestAllowsNetwork reports whether the api token of a web request can use a network
+func requestAllowsNetwork(r *http.Request, network string) bool {
+	_, ok := restrictNetwork(r, network)
+	return ok
+}
+
+// createToken stores a new api token and returns the token, which cannot be recovered later
+func createToken(name string, scopes string, network string, expires string) (string, APIToken, error) {
+	if name == "" {
+		return "", APIToken{}, ValidationError{"token name is required"}
+	}
+	token := APIToken{Name: name, Scopes: splitScopes(scopes), Network: network, Created: time.Now().UTC().Format(time.RFC3339)}
+	if err := checkScopes(token.Scopes); err != nil {
+		return "", APIToken{}, ValidationError{err.Error()}
+	}
+	var err error
+	if token.Expires, err = parseExpiry(expires, time.Now()); err != nil {
+		return "", APIToken{}, ValidationError{err.Error()}
+	}
+	if network != "" {
+		if _, err := store.GetNetwork(network); err == ErrNotFound {
+			return "", APIToken{}, ValidationError{"network does not exist: " + network}
+		} else if err != nil {
+			return "", APIToken{}, err
+		}
+	}
+	mytokens, err := store.ListTokens()
+	if err != nil {
+		return "", APIToken{}, err
+	}
+	for _, existing := range mytokens {
+		if strings.EqualFold(existing.Name, name) {
+			return "", APIToken{}, ConflictError{"token already exists: " + name}
+		}
+	}
+
+	plaintoken, err := generateToken()
+	if err != nil {
+		return "", APIToken{}, err
+	}
+	token.Hash = hashToken(plaintoken)
+	if err := store.CreateToken(token); err != nil {
+		return "", APIToken{}, err
+	}
+	return plaintoken, token, nil
+}
+
+// addToken creates an api token from the cli and prints it
+func addToken(name string, scopes string, network string, expires string) error {
+	plaintoken, token, err := createToken(name, scopes, network, expires)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Created api token: " + token.Name)
+	fmt.Println("Scopes:  " + strings.Join(token.Scopes, ","))
+	fmt.Println("Network: " + token.Network)
+	fmt.Println("Expires: " + token.Expires)
+	fmt.Println("Token:   " + plaintoken)
+	fmt.Println("The token cannot be shown again, keep it somewhere safe")
+	return nil
+}
+
+// listTokens prints the api tokens, the tokens themselves are never shown
+func listTokens(printjson bool) error {
+	mytokens, err := store.ListTokens()
+	if err != nil {
+		return err
+	}
+	if printjson {
+		if mytokens == nil {
+			mytokens = []APIToken{}
+		}
+		c, err := json.Marshal(mytokens)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", c)
+		return nil
+	}
+	now := time.Now()
+	for _, token := range mytokens {
+		status := ""
+		if token.Expired(now) {
+			status = "  (expired)"
+		}
+		fmt.Printf("%s  %s  %s  %s%s\n", token.Name, strings.Join(token.Scopes, ","), token.Network, token.Expires, status)
+	}
+	return nil
+}
+
+// delToken revokes an api token
+func delToken(name string) error {
+	return store.DeleteToken(name)
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// columns of the csv files of hosts and networks, named after the json fields
+var (
+	hostCSVColumns    = []string{"Network", "IPv4", "IPv6", "Hostname", "Aliases", "MAC", "AllowDuplicate", "Status"}
+	networkCSVColumns = []string{"Network", "CIDR", "Description", "AutoApprove"}
+)
+
+// legacy and derived json fields that are accepted in csv files but not exported
+var (
+	hostCSVIgnored    = []string{"PaddedIP", "Short1", "Short2", "Short3", "Short4"}
+	networkCSVIgnored = []string{"PaddedNetwork"}
+)
+
+// csvRow is a row of a csv file, its values keyed by the lower case column name
+type csvRow struct {
+	Line   int
+	Values map[string]string
+}
+
+// writeHostsCSV writes hosts as csv, aliases are separated by spaces
+func writeHostsCSV(w io.Writer, myhosts []Host, mynetworks []SingleNetwork) error {
+	out := csv.NewWriter(w)
+	out.Write(hostCSVColumns)
+	for _, host := range myhosts {
+		out.Write([]string{host.Network, host.IPv4, host.IPv6, host.Hostname, strings.Join(host.Aliases, " "), host.MAC, strconv.FormatBool(host.AllowDuplicate), host.Status})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// writeNetworksCSV writes networks as csv
+func writeNetworksCSV(w io.Writer, mynetworks []SingleNetwork) error {
+	out := csv.NewWriter(w)
+	out.Write(networkCSVColumns)
+	for _, network := range mynetworks {
+		out.Write([]string{network.Network, network.CIDR, network.Description, strconv.FormatBool(network.AutoApprove)})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// exportCSV writes every host, whatever its status, or every network as csv, or only those within network
+func exportCSV(w io.Writer, kind string, network string) error {
+	switch strings.ToLower(kind) {
+	case "hosts":
+		return writeFormat(w, HostFilter{Network: network}, "csv")
+	case "networks":
+		mynetworks, err := store.ListNetworks(NetworkFilter{Network: network})
+		if err != nil {
+			return err
+		}
+		return writeNetworksCSV(w, mynetworks)
+	}
+	return ValidationError{"--export-csv must be hosts or networks: " + kind}
+}
+
+// readCSV reads the header and rows of a csv file. Each line is read on its own so errors can give the line
+// number, which means values cannot contain new lines
+func readCSV(r io.Reader) ([]string, []csvRow, error) {
+	var header []string
+	var rows []csvRow
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		reader := csv.NewReader(strings.NewReader(scanner.Text()))
+		reader.TrimLeadingSpace = true
+		record, err := reader.Read()
+		if err != nil {
+			return nil, nil, ValidationError{fmt.Sprintf("line %d: %s", line, err)}
+		}
+		if header == nil {
+			for _, column := range record {
+				header = append(header, strings.TrimSpace(column))
+			}
+			continue
+		}
+		if len(record) != len(header) {
+			return nil, nil, ValidationError{fmt.Sprintf("line %d: has %d columns but the header has %d", line, len(record), len(header))}
+		}
+		values := make(map[string]string)
+		for i, column := range header {
+			values[strings.ToLower(column)] = strings.TrimSpace(record[i])
+		}
+		rows = append(rows, csvRow{Line: line, Values: values})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if header == nil {
+		return nil, nil, ValidationError{"csv file is empty"}
+	}
+	return header, rows, nil
+}
+
+// checkCSVHeader makes sure a header only has known columns and has all of the required columns
+func checkCSVHeader(header []string, known []string, required []string) error {
+	columns := make(map[string]bool)
+	for _, column := range known {
+		columns[strings.ToLower(column)] = true
+	}
+	present := make(map[string]bool)
+	for _, column := range header {
+		if !columns[strings.ToLower(column)] {
+			return ValidationError{"line 1: unknown column " + column + ", columns are: " + strings.Join(known, ", ")}
+		}
+		present[strings.ToLower(column)] = true
+	}
+	for _, column := range required {
+		if !present[strings.ToLower(column)] {
+			return ValidationError{"line 1: column " + column + " is required"}
+		}
+	}
+	return nil
+}
+
+// csvBool reads a true or false column, blank is false
+func csvBool(row csvRow, column string) (bool, error) {
+	value := row.Values[strings.ToLower(column)]
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, ValidationError{column + " must be true or false: " + value}
+	}
+	return b, nil
+}
+
+// csvChange is a validated row of a csv import, original is nil when the row adds a host or network
+type csvChange struct {
+	Line            int
+	Host            Host
+	OriginalHost    *Host
+	Network         SingleNetwork
+	OriginalNetwork *SingleNetwork
+}
+
+// isUserError reports whether an error is a problem with the data rather than the database
+func isUserError(err error) bool {
+	switch err.(type) {
+	case ValidationError, ConflictError:
+		return true
+	}
+	return false
+}
+
+// planHostsCSV validates each row of a hosts csv file, rows with the fqdn and network of an existing host
+// update it and the rest add hosts. A blank Status keeps the status of an existing host or makes a new host active
+func planHostsCSV(rows []csvRow) ([]csvChange, []string, error) {
+	var changes []csvChange
+	var problems []string
+	seen := make(map[string]int)
+	claimed := make(map[string]int)
+	for _, row := range rows {
+		v := row.Values
+		host := Host{Network: v["network"], IPv4: v["ipv4"], IPv6: v["ipv6"], Hostname: v["hostname"], MAC: PrepareMac(v["mac"]), Status: strings.ToLower(v["status"])}
+		host.Aliases = mergeAliases(strings.Fields(strings.Replace(v["aliases"], ",", " ", -1)), v["short1"], v["short2"], v["short3"], v["short4"])
+		host = normaliseAliases(host)
+		allowduplicate, err := csvBool(row, "AllowDuplicate")
+		host.AllowDuplicate = allowduplicate
+
+		var original *Host
+		if err == nil {
+			if existing, geterr := store.GetHost(host.Hostname, host.Network); geterr == nil {
+				original = &existing
+				if host.Status == "" {
+					host.Status = existing.Status
+				}
+				// legacy upper case macs are left alone so exported rows import unchanged
+				if strings.EqualFold(host.MAC, existing.MAC) {
+					host.MAC = existing.MAC
+				}
+			} else if geterr != ErrNotFound {
+				return nil, nil, geterr
+			}
+			if host.Status == "" {
+				host.Status = hostActive
+			}
+		}
+
+		key := strings.ToLower(host.Hostname + " / " + host.Network)
+		// unchanged rows are not checked, so hosts with legacy data can be exported and imported again
+		if err == nil && original != nil && sameHostDetails(*original, host) && original.Status == host.Status {
+			if _, ok := seen[key]; !ok {
+				seen[key] = row.Line
+				continue
+			}
+		}
+		if err == nil {
+			err = validateHost(host, original)
+		}
+		if line, ok := seen[key]; ok && err == nil {
+			err = ConflictError{"host is already on line " + strconv.Itoa(line) + ": " + host.Hostname + " / " + host.Network}
+		}
+		// addresses used twice within the file are not caught by the database checks
+		for _, address := range []string{host.IPv4, host.IPv6, host.MAC} {
+			if line, ok := claimed[strings.ToLower(address)]; ok && address != "" && !host.AllowDuplicate && err == nil {
+				err = ConflictError{address + " is already used on line " + strconv.Itoa(line)}
+			}
+		}
+		if err != nil {
+			if !isUserError(err) {
+				return nil, nil, err
+			}
+			problems = append(problems, fmt.Sprintf("line %d: %s", row.Line, err))
+			continue
+		}
+
+		seen[key] = row.Line
+		if !host.AllowDuplicate {
+			for _, address := range []string{host.IPv4, host.IPv6, host.MAC} {
+				if address != "" {
+					claimed[strings.ToLower(address)] = row.Line
+				}
+			}
+		}
+		changes = append(changes, csvChange{Line: row.Line, Host: host, OriginalHost: original})
+	}
+	return changes, problems, nil
+}
+
+// planNetworksCSV validates each row of a networks csv file, rows with the name of an existing network update it
+// and the rest add networks
+func planNetworksCSV(rows []csvRow) ([]csvChange, []string, error) {
+	var changes []csvChange
+	var problems []string
+	seen := make(map[string]int)
+	for _, row := range rows {
+		network := SingleNetwork{Network: row.Values["network"], CIDR: row.Values["cidr"], Description: row.Values["description"]}
+		autoapprove, err := csvBool(row, "AutoApprove")
+		network.AutoApprove = autoapprove
+
+		var original *SingleNetwork
+		if err == nil {
+			if existing, geterr := store.GetNetwork(network.Network); geterr == nil {
+				original = &existing
+			} else if geterr != ErrNotFound {
+				return nil, nil, geterr
+			}
+			err = validateNetwork(network, original)
+		}
+		if line, ok := seen[strings.ToLower(network.Network)]; ok && err == nil {
+			err = ConflictError{"network is already on line " + strconv.Itoa(line) + ": " + network.Network}
+		}
+		if err != nil {
+			if !isUserError(err) {
+				return nil, nil, err
+			}
+			problems = append(problems, fmt.Sprintf("line %d: %s", row.Line, err))
+			continue
+		}
+
+		seen[strings.ToLower(network.Network)] = row.Line
+		if original != nil && original.CIDR == network.CIDR && original.Description == network.Description && original.AutoApprove == network.AutoApprove {
+			continue
+		}
+		changes = append(changes, csvChange{Line: row.Line, Network: network, OriginalNetwork: original})
+	}
+	return changes, problems, nil
+}
+
+// importCSV adds and updates the hosts or networks of a csv file, telling them apart by the header row. Every
+// row is checked first, and when any row has a problem they are all printed and nothing is imported. Otherwise
+// the rows are written within a single transaction, each recorded in the audit log
+func importCSV(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	header, rows, err := readCSV(file)
+	if err != nil {
+		return err
+	}
+
+	// only hosts have a Hostname column
+	kind := "networks"
+	for _, column := range header {
+		if strings.EqualFold(column, "Hostname") {
+			kind = "hosts"
+		}
+	}
+	var changes []csvChange
+	var problems []string
+	if kind == "hosts" {
+		if err := checkCSVHeader(header, append(append([]string{}, hostCSVColumns...), hostCSVIgnored...), []string{"Network", "IPv4", "Hostname"}); err != nil {
+			return err
+		}
+		changes, problems, err = planHostsCSV(rows)
+	} else {
+		if err := checkCSVHeader(header, append(append([]string{}, networkCSVColumns...), networkCSVIgnored...), []string{"Network", "CIDR"}); err != nil {
+			return err
+		}
+		changes, problems, err = planNetworksCSV(rows)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return ValidationError{fmt.Sprintf("%d of %d rows have problems, nothing was imported", len(problems), len(rows))}
+	}
+
+	var created, updated int
+	audit := cliAudit()
+	err = store.InTransaction(func(txstore Store) error {
+		for i := range changes {
+			change := &changes[i]
+			var err error
+			switch {
+			case kind == "networks" && change.OriginalNetwork == nil:
+				if err = txstore.CreateNetwork(change.Network); err == nil {
+					err = recordNetworkChange(txstore, audit, auditAddNetwork, nil, &change.Network)
+				}
+				created++
+			case kind == "networks":
+				if err = txstore.UpdateNetwork(change.OriginalNetwork.Network, change.Network); err == nil {
+					err = recordNetworkChange(txstore, audit, auditUpdateNetwork, change.OriginalNetwork, &change.Network)
+				}
+				updated++
+			case change.OriginalHost == nil:
+				if err = txstore.CreateHost(change.Host); err == nil {
+					err = recordHostChange(txstore, audit, auditAddHost, nil, &change.Host)
+				}
+				created++
+			default:
+				if err = txstore.UpdateHost(change.OriginalHost.Hostname, change.OriginalHost.Network, change.Host); err == nil {
+					err = recordHostChange(txstore, audit, auditUpdateHost, change.OriginalHost, &change.Host)
+				}
+				updated++
+			}
+			if err != nil {
+				return fmt.Errorf("line %d: %s", change.Line, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("nothing was imported: %s", err)
+	}
+	fmt.Printf("imported %s from %s: %d created, %d updated, %d unchanged\n", kind, filename, created, updated, len(rows)-created-updated)
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsZone holds the zone apex and soa settings the dns server answers with
+type dnsZone struct {
+	Origin     string
+	Nameserver string
+	Hostmaster string
+	TTL        uint32
+	Serial     uint32
+	Refresh    uint32
+	Retry      uint32
+	Expire     uint32
+	Minimum    uint32
+	AliasMode  string
+}
+
+// dnsZoneFromConfig reads the settings of the DNSZone served by the dns server, a DNSSerial of 0 uses
+// the time the server started
+func dnsZoneFromConfig() (dnsZone, error) {
+	if strings.Trim(viper.GetString("DNSZone"), ".") == "" {
+		return dnsZone{}, errors.New("DNSZone must be set, eg narco.tk")
+	}
+	zone, err := dnsZoneSettings(viper.GetString("DNSZone"))
+	if err != nil {
+		return dnsZone{}, err
+	}
+	if zone.Serial == 0 {
+		zone.Serial = uint32(time.Now().Unix())
+	}
+	return zone, nil
+}
+
+// dnsZoneSettings reads the soa settings of a zone from the configuration, a blank DNSNameserver and DNSHostmaster
+// become ns1 and hostmaster within the DNSZone, or within origin when no DNSZone is set
+func dnsZoneSettings(origin string) (dnsZone, error) {
+	zone := dnsZone{
+		Origin:     strings.ToLower(dns.Fqdn(origin)),
+		Nameserver: viper.GetString("DNSNameserver"),
+		Hostmaster: viper.GetString("DNSHostmaster"),
+		TTL:        uint32(viper.GetInt("DNSTTL")),
+		Serial:     uint32(viper.GetInt("DNSSerial")),
+		Refresh:    uint32(viper.GetInt("DNSRefresh")),
+		Retry:      uint32(viper.GetInt("DNSRetry")),
+		Expire:     uint32(viper.GetInt("DNSExpire")),
+		Minimum:    uint32(viper.GetInt("DNSMinimumTTL")),
+		AliasMode:  strings.ToLower(viper.GetString("DNSAliases")),
+	}
+	if _, ok := dns.IsDomainName(zone.Origin); !ok || zone.Origin == "." {
+		return dnsZone{}, errors.New("zone is not a valid domain name: " + zone.Origin)
+	}
+	if zone.AliasMode != "cname" && zone.AliasMode != "a" {
+		return dnsZone{}, errors.New("DNSAliases must be cname or a: " + zone.AliasMode)
+	}
+	apex := zone.Origin
+	if strings.Trim(viper.GetString("DNSZone"), ".") != "" {
+		apex = strings.ToLower(dns.Fqdn(viper.GetString("DNSZone")))
+	}
+	if (zone.Nameserver == "" || zone.Hostmaster == "") && reverseZone(apex) {
+		return dnsZone{}, errors.New("set DNSZone or DNSNameserver and DNSHostmaster so reverse zone " + zone.Origin + " has a nameserver")
+	}
+	if zone.Nameserver == "" {
+		zone.Nameserver = "ns1." + apex
+	}
+	if zone.Hostmaster == "" {
+		zone.Hostmaster = "hostmaster." + apex
+	}
+	// hostmaster may be given as an email address
+	zone.Nameserver, zone.Hostmaster = dns.Fqdn(zone.Nameserver), dns.Fqdn(strings.Replace(zone.Hostmaster, "@", ".", 1))
+	return zone, nil
+}
+
+// header returns the header of a record within the zone
+func (z dnsZone) header(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: z.TTL}
+}
+
+// soa returns the soa record of the zone
+func (z dnsZone) soa() dns.RR {
+	return &dns.SOA{Hdr: z.header(z.Origin, dns.TypeSOA), Ns: z.Nameserver, Mbox: z.Hostmaster, Serial: z.Serial, Refresh: z.Refresh, Retry: z.Retry, Expire: z.Expire, Minttl: z.Minimum}
+}
+
+// qualifyName turns a host name or alias in to a lower case fully qualified name, names without a dot are within domain
+func qualifyName(name string, domain string) string {
+	if !strings.Contains(strings.TrimSuffix(name, "."), ".") {
+		name = name + "." + domain
+	}
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// parentDomain returns the domain a fully qualified name is within
+func parentDomain(name string) string {
+	if i := strings.Index(name, "."); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// reverseZone reports whether a name is within in-addr.arpa or ip6.arpa
+func reverseZone(name string) bool {
+	return dns.IsSubDomain("in-addr.arpa.", name) || dns.IsSubDomain("ip6.arpa.", name)
+}
+
+// reverseIP returns the address a name within in-addr.arpa or ip6.arpa points at, or nil for any other name
+func reverseIP(name string) net.IP {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	switch {
+	case len(labels) == 6 && labels[4] == "in-addr" && labels[5] == "arpa":
+		return net.ParseIP(labels[3] + "." + labels[2] + "." + labels[1] + "." + labels[0]).To4()
+	case len(labels) == 34 && labels[32] == "ip6" && labels[33] == "arpa":
+		var address string
+		for i := 31; i >= 0; i-- {
+			if len(labels[i]) != 1 {
+				return nil
+			}
+			address = address + labels[i]
+			if i%4 == 0 && i > 0 {
+				address = address + ":"
+			}
+		}
+		return net.ParseIP(address)
+	}
+	return nil
+}
+
+// addressRecords returns the A and AAAA records of a host that match qtype, named name
+func (z dnsZone) addressRecords(name string, host Host, qtype uint16) []dns.RR {
+	var records []dns.RR
+	if ip := net.ParseIP(host.IPv4).To4(); ip != nil && (qtype == dns.TypeA || qtype == dns.TypeANY) {
+		records = append(records, &dns.A{Hdr: z.header(name, dns.TypeA), A: ip})
+	}
+	if ip := net.ParseIP(host.IPv6); ip != nil && ip.To4() == nil && (qtype == dns.TypeAAAA || qtype == dns.TypeANY) {
+		records = append(records, &dns.AAAA{Hdr: z.header(name, dns.TypeAAAA), AAAA: ip})
+	}
+	return records
+}
+
+// answer fills in the reply to a question from the hosts in the zone
+func (z dnsZone) answer(m *dns.Msg, question dns.Question, mynetworks []SingleNetwork, myhosts []Host) {
+	qname := strings.ToLower(dns.Fqdn(question.Name))
+
+	if reverseZone(qname) {
+		z.answerReverse(m, question, mynetworks, myhosts)
+		return
+	}
+
+	if !dns.IsSubDomain(z.Origin, qname) {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	m.Authoritative = true
+
+	found := qname == z.Origin
+	if found {
+		m.Answer = append(m.Answer, z.apexRecords(question.Qtype)...)
+	}
+	ishost := false
+	for _, host := range myhosts {
+		if qualifyName(host.Hostname, z.Origin) == qname {
+			ishost = true
+			m.Answer = append(m.Answer, z.addressRecords(qname, host, question.Qtype)...)
+		}
+	}
+	found = found || ishost
+
+	// a cname cannot sit alongside other records, so aliases that are also host names are ignored
+	// and an alias shared by several hosts points at the first of them
+	if !ishost {
+	aliases:
+		for _, host := range myhosts {
+			fqdn := qualifyName(host.Hostname, z.Origin)
+			for _, alias := range host.Aliases {
+				if qualifyName(alias, parentDomain(fqdn)) != qname {
+					continue
+				}
+				found = true
+				if z.AliasMode == "a" {
+					m.Answer = append(m.Answer, z.addressRecords(qname, host, question.Qtype)...)
+					continue aliases
+				}
+				m.Answer = append(m.Answer, &dns.CNAME{Hdr: z.header(qname, dns.TypeCNAME), Target: fqdn})
+				// save resolvers a second query when the target is within the zone
+				if question.Qtype != dns.TypeCNAME && dns.IsSubDomain(z.Origin, fqdn) {
+					m.Answer = append(m.Answer, z.addressRecords(fqdn, host, question.Qtype)...)
+				}
+				break aliases
+			}
+		}
+	}
+
+	if !found {
+		m.Rcode = dns.RcodeNameError
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, z.soa())
+	}
+}
+
+// apexRecords returns the soa or ns record of the zone asked for by a query of its apex
+func (z dnsZone) apexRecords(qtype uint16) []dns.RR {
+	switch qtype {
+	case dns.TypeSOA:
+		return []dns.RR{z.soa()}
+	case dns.TypeNS:
+		return []dns.RR{&dns.NS{Hdr: z.header(z.Origin, dns.TypeNS), Ns: z.Nameserver}}
+	}
+	return nil
+}
+
+// reverseOrigin returns the reverse zone of a network that holds a name within in-addr.arpa or ip6.arpa,
+// or blank when the name is not within the reverse zones of any network
+func reverseOrigin(name string, mynetworks []SingleNetwork) string {
+	origin := ""
+	for _, network := range mynetworks {
+		// networks without a usable cidr have no reverse zones
+		origins, _ := reverseZonesForCIDR(network.CIDR)
+		for _, networkorigin := range origins {
+			if dns.IsSubDomain(networkorigin, name) && len(networkorigin) > len(origin) {
+				origin = networkorigin
+			}
+		}
+	}
+	return origin
+}
+
+// answerReverse fills in the reply to a query within in-addr.arpa or ip6.arpa. Only the reverse zones of the
+// networks are served, queries for any other address are refused
+func (z dnsZone) answerReverse(m *dns.Msg, question dns.Question, mynetworks []SingleNetwork, myhosts []Host) {
+	qname := strings.ToLower(dns.Fqdn(question.Name))
+	origin := reverseOrigin(qname, mynetworks)
+	if origin == "" {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	m.Authoritative = true
+	reverse := z
+	reverse.Origin = origin
+
+	found := qname == origin
+	if found {
+		m.Answer = append(m.Answer, reverse.apexRecords(question.Qtype)...)
+	}
+	if ip := reverseIP(qname); ip != nil {
+		for _, host := range myhosts {
+			if ip.Equal(net.ParseIP(host.IPv4)) || ip.Equal(net.ParseIP(host.IPv6)) {
+				found = true
+				if question.Qtype == dns.TypePTR || question.Qtype == dns.TypeANY {
+					m.Answer = append(m.Answer, &dns.PTR{Hdr: z.header(qname, dns.TypePTR), Ptr: qualifyName(host.Hostname, z.Origin)})
+				}
+			}
+		}
+	}
+
+	if !found {
+		m.Rcode = dns.RcodeNameError
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, reverse.soa())
+	}
+}
+
+// dnsRecords holds the active hosts and the networks the dns server answers from, so each query does
+// not read the whole database. They are read again once they are older than maxage
+type dnsRecords struct {
+	sync.RWMutex
+	maxage   time.Duration
+	loaded   time.Time
+	networks []SingleNetwork
+	hosts    []Host
+}
+
+// get returns the networks and active hosts, reading them from the database when they have not been read
+// yet or are older than maxage
+func (c *dnsRecords) get() ([]SingleNetwork, []Host, error) {
+	c.RLock()
+	if !c.loaded.IsZero() && time.Since(c.loaded) < c.maxage {
+		defer c.RUnlock()
+		return c.networks, c.hosts, nil
+	}
+	c.RUnlock()
+
+	c.Lock()
+	defer c.Unlock()
+	// another query may have read them while waiting for the lock
+	if !c.loaded.IsZero() && time.Since(c.loaded) < c.maxage {
+		return c.networks, c.hosts, nil
+	}
+	myhosts, err := store.ListHosts(HostFilter{Status: hostActive})
+	if err != nil {
+		return nil, nil, err
+	}
+	mynetworks, err := store.ListNetworks(NetworkFilter{})
+	if err != nil {
+		return nil, nil, err
+	}
+	c.networks, c.hosts, c.loaded = mynetworks, myhosts, time.Now()
+	return c.networks, c.hosts, nil
+}
+
+// dnsHandler answers dns queries from the active hosts in the database, read at most once every DNSCacheTime seconds
+func dnsHandler(zone dnsZone) dns.HandlerFunc {
+	records := &dnsRecords{maxage: time.Duration(viper.GetInt("DNSCacheTime")) * time.Second}
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch {
+		case len(r.Question) != 1:
+			m.Rcode = dns.RcodeFormatError
+		case r.Question[0].Qclass != dns.ClassINET && r.Question[0].Qclass != dns.ClassANY:
+			m.Rcode = dns.RcodeRefused
+		default:
+			mynetworks, myhosts, err := records.get()
+			if showerror("cannot answer dns query", err, "warn") {
+				m.Rcode = dns.RcodeServerFailure
+				break
+			}
+			zone.answer(m, r.Question[0], mynetworks, myhosts)
+			log.Printf("DNS: %s %s %s %s", w.RemoteAddr(), dns.TypeToString[r.Question[0].Qtype], r.Question[0].Name, dns.RcodeToString[m.Rcode])
+		}
+		showerror("cannot send dns reply", w.WriteMsg(m), "warn")
+	}
+}
+
+// startDNS serves the hosts database as an authoritative dns zone over udp and tcp
+func startDNS(listenip string, listenport string) {
+	zone, err := dnsZoneFromConfig()
+	showerror("cannot start dns server", err, "fatal")
+
+	address := net.JoinHostPort(listenip, listenport)
+	failed := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{Addr: address, Net: network, Handler: dnsHandler(zone)}
+		go func() {
+			failed <- server.ListenAndServe()
+		}()
+	}
+	showerror("Starting DNS Server for "+zone.Origin+" serial "+strconv.FormatUint(uint64(zone.Serial), 10), errors.New(address), "info")
+	showerror("cannot start dns server", <-failed, "fatal")
+}
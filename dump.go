@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dumpVersion is the version of the document written by --dump, restores refuse documents from newer versions.
+// Version 2 added the audit log
+const dumpVersion = 2
+
+// dumpNetwork is a network within a dump
+type dumpNetwork struct {
+	Network     string `json:"Network" yaml:"Network"`
+	CIDR        string `json:"CIDR" yaml:"CIDR"`
+	Description string `json:"Description" yaml:"Description"`
+	AutoApprove bool   `json:"AutoApprove" yaml:"AutoApprove"`
+}
+
+// dumpHost is a host within a dump
+type dumpHost struct {
+	Network        string   `json:"Network" yaml:"Network"`
+	IPv4           string   `json:"IPv4" yaml:"IPv4"`
+	IPv6           string   `json:"IPv6" yaml:"IPv6"`
+	Hostname       string   `json:"Hostname" yaml:"Hostname"`
+	Aliases        []string `json:"Aliases" yaml:"Aliases"`
+	MAC            string   `json:"MAC" yaml:"MAC"`
+	AllowDuplicate bool     `json:"AllowDuplicate" yaml:"AllowDuplicate"`
+	Status         string   `json:"Status" yaml:"Status"`
+}
+
+// dumpToken is an api token within a dump, only the hash of the token is stored so the token itself is not revealed
+type dumpToken struct {
+	Name    string   `json:"Name" yaml:"Name"`
+	Hash    string   `json:"Hash" yaml:"Hash"`
+	Scopes  []string `json:"Scopes" yaml:"Scopes"`
+	Network string   `json:"Network" yaml:"Network"`
+	Expires string   `json:"Expires" yaml:"Expires"`
+	Created string   `json:"Created" yaml:"Created"`
+}
+
+// dumpRegistrationKey is a registration key within a dump
+type dumpRegistrationKey struct {
+	Name        string   `json:"Name" yaml:"Name"`
+	Key         string   `json:"Key" yaml:"Key"`
+	Networks    []string `json:"Networks" yaml:"Networks"`
+	SourceCIDRs []string `json:"SourceCIDRs" yaml:"SourceCIDRs"`
+	MACPrefixes []string `json:"MACPrefixes" yaml:"MACPrefixes"`
+	Expires     string   `json:"Expires" yaml:"Expires"`
+	MaxUses     int      `json:"MaxUses" yaml:"MaxUses"`
+	Uses        int      `json:"Uses" yaml:"Uses"`
+	Created     string   `json:"Created" yaml:"Created"`
+}
+
+// dumpAuditEntry is an entry of the audit log within a dump, Before and After hold the json of the host or
+// network so they read the same in json and yaml dumps
+type dumpAuditEntry struct {
+	Time     string `json:"Time" yaml:"Time"`
+	Actor    string `json:"Actor" yaml:"Actor"`
+	SourceIP string `json:"SourceIP" yaml:"SourceIP"`
+	Action   string `json:"Action" yaml:"Action"`
+	Network  string `json:"Network" yaml:"Network"`
+	Hostname string `json:"Hostname" yaml:"Hostname"`
+	Before   string `json:"Before" yaml:"Before"`
+	After    string `json:"After" yaml:"After"`
+}
+
+// dumpDocument is everything in the database, in a form that does not depend on the DatabaseType. Secrets is
+// true when the api tokens and registration keys are included
+type dumpDocument struct {
+	Version          int                   `json:"Version" yaml:"Version"`
+	SchemaVersion    int                   `json:"SchemaVersion" yaml:"SchemaVersion"`
+	Created          string                `json:"Created" yaml:"Created"`
+	Secrets          bool                  `json:"Secrets" yaml:"Secrets"`
+	Networks         []dumpNetwork         `json:"Networks" yaml:"Networks"`
+	Hosts            []dumpHost            `json:"Hosts" yaml:"Hosts"`
+	APITokens        []dumpToken           `json:"APITokens,omitempty" yaml:"APITokens,omitempty"`
+	RegistrationKeys []dumpRegistrationKey `json:"RegistrationKeys,omitempty" yaml:"RegistrationKeys,omitempty"`
+	AuditLog         []dumpAuditEntry      `json:"AuditLog" yaml:"AuditLog"`
+}
+
+// yamlFilename reports whether a file should be written as yaml rather than json
+func yamlFilename(filename string) bool {
+	extension := strings.ToLower(filepath.Ext(filename))
+	return extension == ".yaml" || extension == ".yml"
+}
+
+// buildDump reads every network, host and audit log entry, and when secrets is true every api token and
+// registration key
+func buildDump(secrets bool, now time.Time) (dumpDocument, error) {
+	document := dumpDocument{Version: dumpVersion, SchemaVersion: latestSchemaVersion(), Created: now.UTC().Format(time.RFC3339), Secrets: secrets, Networks: []dumpNetwork{}, Hosts: []dumpHost{}, AuditLog: []dumpAuditEntry{}}
+	mynetworks, err := store.ListNetworks(NetworkFilter{})
+	if err != nil {
+		return document, err
+	}
+	for _, network := range mynetworks {
+		document.Networks = append(document.Networks, dumpNetwork{Network: network.Network, CIDR: network.CIDR, Description: network.Description, AutoApprove: network.AutoApprove})
+	}
+	myhosts, err := store.ListHosts(HostFilter{})
+	if err != nil {
+		return document, err
+	}
+	for _, host := range myhosts {
+		document.Hosts = append(document.Hosts, dumpHost{Network: host.Network, IPv4: host.IPv4, IPv6: host.IPv6, Hostname: host.Hostname, Aliases: host.Aliases, MAC: host.MAC, AllowDuplicate: host.AllowDuplicate, Status: host.Status})
+	}
+	entries, err := store.ListAuditEntries(AuditFilter{})
+	if err != nil {
+		return document, err
+	}
+	// oldest first, so a restore adds them in the order they were made
+	for i := len(entries) - 1; i >= 0; i-- {
+		document.AuditLog = append(document.AuditLog, dumpAuditEntryFrom(entries[i]))
+	}
+	if !secrets {
+		return document, nil
+	}
+
+	tokens, err := store.ListTokens()
+	if err != nil {
+		return document, err
+	}
+	for _, token := range tokens {
+		document.APITokens = append(document.APITokens, dumpToken{Name: token.Name, Hash: token.Hash, Scopes: token.Scopes, Network: token.Network, Expires: token.Expires, Created: token.Created})
+	}
+	keys, err := store.ListRegistrationKeys()
+	if err != nil {
+		return document, err
+	}
+	for _, key := range keys {
+		document.RegistrationKeys = append(document.RegistrationKeys, dumpRegistrationKey{Name: key.Name, Key: key.Key, Networks: key.Networks, SourceCIDRs: key.SourceCIDRs, MACPrefixes: key.MACPrefixes, Expires: key.Expires, MaxUses: key.MaxUses, Uses: key.Uses, Created: key.Created})
+	}
+	return document, nil
+}
+
+// dumpAuditEntryFrom returns an audit log entry as it is dumped
+func dumpAuditEntryFrom(entry AuditEntry) dumpAuditEntry {
+	return dumpAuditEntry{Time: entry.Time, Actor: entry.Actor, SourceIP: entry.SourceIP, Action: entry.Action, Network: entry.Network, Hostname: entry.Hostname, Before: string(entry.Before), After: string(entry.After)}
+}
+
+// dumpDatabase writes the database to a json file, or a yaml file when the filename ends in .yaml or .yml.
+// A filename of - writes json to stdout
+func dumpDatabase(filename string, secrets bool) error {
+	document, err := buildDump(secrets, time.Now())
+	if err != nil {
+		return err
+	}
+	var content []byte
+	if yamlFilename(filename) {
+		content, err = yaml.Marshal(document)
+	} else {
+		content, err = json.MarshalIndent(document, "", "    ")
+		content = append(content, '\n')
+	}
+	if err != nil {
+		return err
+	}
+
+	summary := fmt.Sprintf("dumped %d networks, %d hosts, %d api tokens, %d registration keys and %d audit log entries", len(document.Networks), len(document.Hosts), len(document.APITokens), len(document.RegistrationKeys), len(document.AuditLog))
+	if filename == "-" {
+		os.Stdout.Write(content)
+		log.Println(summary)
+		return nil
+	}
+	// registration keys can be used as they are, so a dump holding them is kept private
+	perm := os.FileMode(0644)
+	if secrets {
+		perm = 0600
+	}
+	if err := writeFileAtomic(filename, content, perm); err != nil {
+		return err
+	}
+	fmt.Println(summary + " to " + filename)
+	return nil
+}
+
+// readDump reads a json or yaml dump, refusing dumps written by newer versions of narcotk-hosts
+func readDump(content []byte) (dumpDocument, error) {
+	var document dumpDocument
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(string(content)), "{") {
+		err = json.Unmarshal(content, &document)
+	} else {
+		err = yaml.Unmarshal(content, &document)
+	}
+	if err != nil {
+		return document, ValidationError{"cannot read dump: " + err.Error()}
+	}
+	if document.Version < 1 {
+		return document, ValidationError{"not a narcotk-hosts dump, it has no Version"}
+	}
+	if document.Version > dumpVersion {
+		return document, ValidationError{"dump version " + strconv.Itoa(document.Version) + " is newer than this narcotk-hosts supports (" + strconv.Itoa(dumpVersion) + "), upgrade narcotk-hosts"}
+	}
+	for i, network := range document.Networks {
+		if network.Network == "" {
+			return document, ValidationError{"network " + strconv.Itoa(i+1) + " has no Network"}
+		}
+	}
+	for i, host := range document.Hosts {
+		if host.Hostname == "" || host.Network == "" {
+			return document, ValidationError{"host " + strconv.Itoa(i+1) + " has no Hostname or Network"}
+		}
+	}
+	for i, entry := range document.AuditLog {
+		// Before and After are stored as json, history could not show an entry holding anything else
+		if (entry.Before != "" && !json.Valid([]byte(entry.Before))) || (entry.After != "" && !json.Valid([]byte(entry.After))) {
+			return document, ValidationError{"audit log entry " + strconv.Itoa(i+1) + " has a Before or After that is not valid json"}
+		}
+	}
+	return document, nil
+}
+
+// restoreDump writes a dump to the database within a single transaction. Replace deletes every network and host,
+// every api token and registration key when the dump holds them and the audit log when the dump holds one, before
+// restoring. Merge keeps what is in the database and replaces anything with the same name, audit log entries
+// already in the database are not added again. The dump is restored as it is, without the checks --addhost
+// makes, so legacy data survives a move between databases
+func restoreDump(txstore Store, document dumpDocument, mode string) error {
+	if mode == "replace" {
+		myhosts, err := txstore.ListHosts(HostFilter{})
+		if err != nil {
+			return err
+		}
+		for _, host := range myhosts {
+			if err := txstore.DeleteHost(host.Hostname, host.Network); err != nil {
+				return err
+			}
+		}
+		mynetworks, err := txstore.ListNetworks(NetworkFilter{})
+		if err != nil {
+			return err
+		}
+		for _, network := range mynetworks {
+			if err := txstore.DeleteNetwork(network.Network); err != nil {
+				return err
+			}
+		}
+		if document.Secrets {
+			tokens, err := txstore.ListTokens()
+			if err != nil {
+				return err
+			}
+			for _, token := range tokens {
+				if err := txstore.DeleteToken(token.Name); err != nil {
+					return err
+				}
+			}
+			keys, err := txstore.ListRegistrationKeys()
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if err := txstore.DeleteRegistrationKey(key.Name); err != nil {
+					return err
+				}
+			}
+		}
+		// dumps before version 2 have no audit log, so the existing one is kept
+		if document.Version >= 2 {
+			if err := txstore.DeleteAuditEntries(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, d := range document.Networks {
+		network := SingleNetwork{Network: d.Network, CIDR: d.CIDR, Description: d.Description, AutoApprove: d.AutoApprove}
+		_, err := txstore.GetNetwork(network.Network)
+		switch err {
+		case nil:
+			err = txstore.UpdateNetwork(network.Network, network)
+		case ErrNotFound:
+			err = txstore.CreateNetwork(network)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot restore network %s: %s", network.Network, err)
+		}
+	}
+	for _, d := range document.Hosts {
+		host := Host{Network: d.Network, IPv4: d.IPv4, IPv6: d.IPv6, Hostname: d.Hostname, Aliases: d.Aliases, MAC: d.MAC, AllowDuplicate: d.AllowDuplicate, Status: d.Status}
+		// hand written dumps may leave out the status, hosts without one would never be listed
+		if host.Status == "" {
+			host.Status = hostActive
+		}
+		if _, err := txstore.GetNetwork(host.Network); err == ErrNotFound {
+			return ValidationError{"cannot restore host " + host.Hostname + ", network does not exist: " + host.Network}
+		} else if err != nil {
+			return err
+		}
+		_, err := txstore.GetHost(host.Hostname, host.Network)
+		switch err {
+		case nil:
+			err = txstore.UpdateHost(host.Hostname, host.Network, host)
+		case ErrNotFound:
+			err = txstore.CreateHost(host)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot restore host %s / %s: %s", host.Hostname, host.Network, err)
+		}
+	}
+	for _, d := range document.APITokens {
+		if err := txstore.DeleteToken(d.Name); err != nil && err != ErrNotFound {
+			return err
+		}
+		if err := txstore.CreateToken(APIToken{Name: d.Name, Hash: d.Hash, Scopes: d.Scopes, Network: d.Network, Expires: d.Expires, Created: d.Created}); err != nil {
+			return fmt.Errorf("cannot restore api token %s: %s", d.Name, err)
+		}
+	}
+	for _, d := range document.RegistrationKeys {
+		if err := txstore.DeleteRegistrationKey(d.Name); err != nil && err != ErrNotFound {
+			return err
+		}
+		if err := txstore.CreateRegistrationKey(RegistrationKey{Name: d.Name, Key: d.Key, Networks: d.Networks, SourceCIDRs: d.SourceCIDRs, MACPrefixes: d.MACPrefixes, Expires: d.Expires, MaxUses: d.MaxUses, Uses: d.Uses, Created: d.Created}); err != nil {
+			return fmt.Errorf("cannot restore registration key %s: %s", d.Name, err)
+		}
+	}
+
+	entries, err := txstore.ListAuditEntries(AuditFilter{})
+	if err != nil {
+		return err
+	}
+	existing := make(map[dumpAuditEntry]bool)
+	for _, entry := range entries {
+		existing[dumpAuditEntryFrom(entry)] = true
+	}
+	for _, d := range document.AuditLog {
+		if existing[d] {
+			continue
+		}
+		entry := AuditEntry{Time: d.Time, Actor: d.Actor, SourceIP: d.SourceIP, Action: d.Action, Network: d.Network, Hostname: d.Hostname}
+		if d.Before != "" {
+			entry.Before = json.RawMessage(d.Before)
+		}
+		if d.After != "" {
+			entry.After = json.RawMessage(d.After)
+		}
+		if err := txstore.CreateAuditEntry(entry); err != nil {
+			return fmt.Errorf("cannot restore audit log entry of %s: %s", d.Time, err)
+		}
+	}
+	return nil
+}
+
+// restoreSummary is recorded in the audit log for a restore, in place of an entry for every host and network
+type restoreSummary struct {
+	File             string
+	Mode             string
+	Created          string
+	Networks         int
+	Hosts            int
+	APITokens        int
+	RegistrationKeys int
+	AuditEntries     int
+}
+
+// restoreDatabase restores a dump file in replace or merge mode, nothing is changed if any of it cannot be restored
+func restoreDatabase(filename string, mode string) error {
+	mode = strings.ToLower(mode)
+	if mode != "replace" && mode != "merge" {
+		return ValidationError{"--restoremode must be replace or merge: " + mode}
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	document, err := readDump(content)
+	if err != nil {
+		return err
+	}
+	if err := store.InTransaction(func(txstore Store) error {
+		if err := restoreDump(txstore, document, mode); err != nil {
+			return err
+		}
+		entry := newAuditEntry(cliAudit(), auditRestore)
+		var err error
+		entry.After, err = json.Marshal(restoreSummary{File: filename, Mode: mode, Created: document.Created, Networks: len(document.Networks), Hosts: len(document.Hosts), APITokens: len(document.APITokens), RegistrationKeys: len(document.RegistrationKeys), AuditEntries: len(document.AuditLog)})
+		if err != nil {
+			return err
+		}
+		return txstore.CreateAuditEntry(entry)
+	}); err != nil {
+		return fmt.Errorf("nothing was restored: %s", err)
+	}
+	fmt.Printf("restored %d networks, %d hosts, %d api tokens, %d registration keys and %d audit log entries from %s (%s)\n", len(document.Networks), len(document.Hosts), len(document.APITokens), len(document.RegistrationKeys), len(document.AuditLog), filename, mode)
+	return nil
+}
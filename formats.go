@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hostFormat writes the hosts and networks out as the configuration of another tool
+type hostFormat func(w io.Writer, myhosts []Host, mynetworks []SingleNetwork) error
+
+// hostFormats are the formats that can be asked for with --format and ?format=
+var hostFormats = map[string]hostFormat{
+	"dhcpd":   writeDhcpd,
+	"dnsmasq": writeDnsmasq,
+	"csv":     writeHostsCSV,
+	"kea":     writeKea,
+}
+
+// formatNames returns the names of the formats that can be asked for
+func formatNames() string {
+	var names []string
+	for name := range hostFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// writeFormat writes the hosts matching filter and the networks they are within in a format, a filter without a
+// network writes every network
+func writeFormat(w io.Writer, filter HostFilter, format string) error {
+	writer, ok := hostFormats[strings.ToLower(format)]
+	if !ok {
+		return ValidationError{"unknown format " + format + ", use: " + formatNames()}
+	}
+	mynetworks, err := store.ListNetworks(NetworkFilter{Network: filter.Network})
+	if err != nil {
+		return err
+	}
+	if filter.Network != "" && len(mynetworks) == 0 {
+		return ErrNotFound
+	}
+	myhosts, err := store.ListHosts(filter)
+	if err != nil {
+		return err
+	}
+	return writer(w, myhosts, mynetworks)
+}
+
+// writeRequestFormat answers a web request that asked for a format
+func writeRequestFormat(w http.ResponseWriter, filter HostFilter, format string) {
+	var b bytes.Buffer
+	if err := writeFormat(&b, filter, format); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", formatContentType(format))
+	w.Write(b.Bytes())
+}
+
+// ipv4Subnet returns the network of an ipv4 cidr, ok is false for ipv6 networks
+func ipv4Subnet(cidr string) (*net.IPNet, bool) {
+	ipnet, err := ParseNetworkCIDR(cidr)
+	if err != nil || ipnet.IP.To4() == nil {
+		return nil, false
+	}
+	return ipnet, true
+}
+
+// formatContentType returns the content type of a format served by the web api
+func formatContentType(format string) string {
+	switch strings.ToLower(format) {
+	case "csv":
+		return "text/csv; charset=utf-8"
+	case "kea":
+		return "application/json"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// dhcpRange returns the first and last usable addresses and the netmask of an ipv4 network,
+// ok is false for ipv6 networks and networks too small to hand out addresses from
+func dhcpRange(cidr string) (first net.IP, last net.IP, netmask net.IP, ok bool) {
+	ipnet, ok := ipv4Subnet(cidr)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	ones, _ := ipnet.Mask.Size()
+	if ones > 30 {
+		return nil, nil, nil, false
+	}
+	start := ipToInt(ipnet.IP)
+	end := start | ^ipToInt(net.IP(ipnet.Mask))
+	return intToIP(start + 1), intToIP(end - 1), net.IP(ipnet.Mask), true
+}
+
+// leaseTime returns the DHCPLeaseTime setting
+func leaseTime() (time.Duration, error) {
+	lease, err := time.ParseDuration(viper.GetString("DHCPLeaseTime"))
+	if err != nil || lease <= 0 {
+		return 0, ValidationError{"DHCPLeaseTime is not a valid duration, eg 12h: " + viper.GetString("DHCPLeaseTime")}
+	}
+	return lease, nil
+}
+
+// dnsmasqLease returns a lease time in the largest unit dnsmasq understands that it is a whole number of
+func dnsmasqLease(lease time.Duration) string {
+	switch {
+	case lease%time.Hour == 0:
+		return fmt.Sprintf("%dh", lease/time.Hour)
+	case lease%time.Minute == 0:
+		return fmt.Sprintf("%dm", lease/time.Minute)
+	}
+	return fmt.Sprintf("%d", lease/time.Second)
+}
+
+// hostsByNetwork groups hosts by the network they are within
+func hostsByNetwork(myhosts []Host) map[string][]Host {
+	grouped := make(map[string][]Host)
+	for _, host := range myhosts {
+		grouped[strings.ToLower(host.Network)] = append(grouped[strings.ToLower(host.Network)], host)
+	}
+	return grouped
+}
+
+// dhcpReservations returns the hosts that can have a dhcp reservation, those with a mac address and an ipv4 address
+func dhcpReservations(myhosts []Host) []Host {
+	var reservations []Host
+	for _, host := range myhosts {
+		if ip := net.ParseIP(host.IPv4); host.MAC != "" && ip != nil && ip.To4() != nil {
+			reservations = append(reservations, host)
+		}
+	}
+	return reservations
+}
+
+// shortName returns the first label of an fqdn
+func shortName(fqdn string) string {
+	return strings.SplitN(fqdn, ".", 2)[0]
+}
+
+// writeDnsmasq writes a dhcp-range for each network, a dhcp-host reservation for each host with a mac
+// address and a host-record for each host
+func writeDnsmasq(w io.Writer, myhosts []Host, mynetworks []SingleNetwork) error {
+	lease, err := leaseTime()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# generated by narcotk-hosts, changes will be overwritten\n")
+	grouped := hostsByNetwork(myhosts)
+	for _, network := range mynetworks {
+		fmt.Fprintf(w, "\n# %s %s %s\n", network.Network, network.CIDR, network.Description)
+		if first, last, netmask, ok := dhcpRange(network.CIDR); ok {
+			fmt.Fprintf(w, "dhcp-range=%s,%s,%s,%s\n", first, last, netmask, dnsmasqLease(lease))
+		}
+		for _, host := range dhcpReservations(grouped[strings.ToLower(network.Network)]) {
+			fmt.Fprintf(w, "dhcp-host=%s,%s,%s\n", host.MAC, host.IPv4, shortName(host.Hostname))
+		}
+		for _, host := range grouped[strings.ToLower(network.Network)] {
+			// dnsmasq refuses to start on an address it cannot parse
+			record := append([]string{host.Hostname}, host.Aliases...)
+			if ip := net.ParseIP(host.IPv4); ip != nil && ip.To4() != nil {
+				record = append(record, host.IPv4)
+			}
+			if ip := net.ParseIP(host.IPv6); ip != nil && ip.To4() == nil {
+				record = append(record, host.IPv6)
+			}
+			fmt.Fprintf(w, "host-record=%s\n", strings.Join(record, ","))
+		}
+	}
+	return nil
+}
+
+// invalidDhcpdNameCharacters are the characters of a network id that cannot be used in a dhcpd host declaration
+var invalidDhcpdNameCharacters = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// dhcpdHostName returns the name of the host declaration of a host, dhcpd needs every host declaration to have
+// a different name so the network is added to the hostname, like server1.example.com_192.168.1
+func dhcpdHostName(host Host) string {
+	return host.Hostname + "_" + invalidDhcpdNameCharacters.ReplaceAllString(host.Network, "-")
+}
+
+// writeDhcpd writes an isc dhcpd subnet declaration for each ipv4 network, holding a host declaration with a
+// fixed address for each host with a mac address
+func writeDhcpd(w io.Writer, myhosts []Host, mynetworks []SingleNetwork) error {
+	lease, err := leaseTime()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# generated by narcotk-hosts, changes will be overwritten\n")
+	grouped := hostsByNetwork(myhosts)
+	for _, network := range mynetworks {
+		ipnet, ok := ipv4Subnet(network.CIDR)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "\n# %s %s %s\n", network.Network, network.CIDR, network.Description)
+		fmt.Fprintf(w, "subnet %s netmask %s {\n", ipnet.IP, net.IP(ipnet.Mask))
+		fmt.Fprintf(w, "\tdefault-lease-time %d;\n", lease/time.Second)
+		for _, host := range dhcpReservations(grouped[strings.ToLower(network.Network)]) {
+			fmt.Fprintf(w, "\thost %s {\n", dhcpdHostName(host))
+			fmt.Fprintf(w, "\t\thardware ethernet %s;\n", strings.ToLower(host.MAC))
+			fmt.Fprintf(w, "\t\tfixed-address %s;\n", host.IPv4)
+			fmt.Fprintf(w, "\t\toption host-name \"%s\";\n", shortName(host.Hostname))
+			fmt.Fprintf(w, "\t}\n")
+		}
+		fmt.Fprintf(w, "}\n")
+	}
+	return nil
+}
+
+// keaReservation is a host reservation within a kea subnet
+type keaReservation struct {
+	HWAddress string `json:"hw-address"`
+	IPAddress string `json:"ip-address"`
+	Hostname  string `json:"hostname"`
+}
+
+// keaSubnet is a subnet4 entry of a kea configuration
+type keaSubnet struct {
+	ID           uint32           `json:"id"`
+	Subnet       string           `json:"subnet"`
+	Comment      string           `json:"comment,omitempty"`
+	Reservations []keaReservation `json:"reservations"`
+}
+
+// keaConfig is the Dhcp4 section of a kea configuration
+type keaConfig struct {
+	Dhcp4 struct {
+		ValidLifetime int64       `json:"valid-lifetime"`
+		Subnet4       []keaSubnet `json:"subnet4"`
+	} `json:"Dhcp4"`
+}
+
+// writeKea writes a kea Dhcp4 configuration with a subnet for each ipv4 network, holding a reservation for each
+// host with a mac address. Subnet ids are the network address of the subnet so they stay the same as networks are
+// added and removed
+func writeKea(w io.Writer, myhosts []Host, mynetworks []SingleNetwork) error {
+	lease, err := leaseTime()
+	if err != nil {
+		return err
+	}
+	var config keaConfig
+	config.Dhcp4.ValidLifetime = int64(lease / time.Second)
+	config.Dhcp4.Subnet4 = []keaSubnet{}
+	grouped := hostsByNetwork(myhosts)
+	for _, network := range mynetworks {
+		ipnet, ok := ipv4Subnet(network.CIDR)
+		if !ok {
+			continue
+		}
+		subnet := keaSubnet{ID: ipToInt(ipnet.IP), Subnet: ipnet.String(), Comment: network.Network + " " + network.Description, Reservations: []keaReservation{}}
+		for _, host := range dhcpReservations(grouped[strings.ToLower(network.Network)]) {
+			subnet.Reservations = append(subnet.Reservations, keaReservation{HWAddress: strings.ToLower(host.MAC), IPAddress: host.IPv4, Hostname: host.Hostname})
+		}
+		config.Dhcp4.Subnet4 = append(config.Dhcp4.Subnet4, subnet)
+	}
+	c, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", c)
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+// markers of the block of a hosts file managed by --sync-hostsfile
+const (
+	hostsBlockBegin = "# BEGIN narcotk-hosts"
+	hostsBlockEnd   = "# END narcotk-hosts"
+)
+
+// hostsBlock returns the managed block of a hosts file, with a line for each ipv4 and ipv6 address of the hosts
+func hostsBlock(myhosts []Host) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\n# managed by narcotk-hosts, changes within this block will be overwritten\n", hostsBlockBegin)
+	for _, host := range myhosts {
+		for _, address := range []string{host.IPv4, host.IPv6} {
+			if net.ParseIP(address) == nil {
+				continue
+			}
+			fmt.Fprintf(&b, "%s\n", strings.TrimRight(fmt.Sprintf("%-15s    %s  %s", address, host.Hostname, strings.Join(host.Aliases, "  ")), " "))
+		}
+	}
+	fmt.Fprintf(&b, "%s\n", hostsBlockEnd)
+	return b.String()
+}
+
+// replaceManagedBlock replaces the managed block within the content of a hosts file, leaving the lines outside
+// the markers alone. The block is appended when the file has no markers yet
+func replaceManagedBlock(existing string, block string) (string, error) {
+	lines := strings.SplitAfter(existing, "\n")
+	begin, end := -1, -1
+	for i, line := range lines {
+		switch strings.TrimSpace(line) {
+		case hostsBlockBegin:
+			if begin != -1 {
+				return "", ValidationError{fmt.Sprintf("line %d: more than one %s marker", i+1, hostsBlockBegin)}
+			}
+			begin = i
+		case hostsBlockEnd:
+			if begin == -1 || end != -1 {
+				return "", ValidationError{fmt.Sprintf("line %d: %s without a %s marker before it", i+1, hostsBlockEnd, hostsBlockBegin)}
+			}
+			end = i
+		}
+	}
+	if begin != -1 && end == -1 {
+		return "", ValidationError{fmt.Sprintf("line %d: %s without a %s marker after it", begin+1, hostsBlockBegin, hostsBlockEnd)}
+	}
+
+	if begin == -1 {
+		if existing != "" && !strings.HasSuffix(existing, "\n") {
+			existing = existing + "\n"
+		}
+		return existing + block, nil
+	}
+	return strings.Join(lines[:begin], "") + block + strings.Join(lines[end+1:], ""), nil
+}
+
+// syncHostsFile rewrites the managed block of a hosts file with the active hosts, or only those within network.
+// The file is only replaced when its content changes, returning whether it was written and the number of hosts
+func syncHostsFile(filename string, network string) (bool, int, error) {
+	myhosts, err := store.ListHosts(HostFilter{Network: network, Status: hostActive})
+	if err != nil {
+		return false, 0, err
+	}
+
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		perm = info.Mode().Perm()
+	}
+	existing, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return false, 0, err
+	}
+	content, err := replaceManagedBlock(string(existing), hostsBlock(myhosts))
+	if err != nil {
+		return false, 0, err
+	}
+	if content == string(existing) {
+		return false, len(myhosts), nil
+	}
+	return true, len(myhosts), writeFileAtomic(filename, []byte(content), perm)
+}
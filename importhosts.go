@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// actions of a hosts file import
+const (
+	importCreate    = "CREATE"
+	importUpdate    = "UPDATE"
+	importUnchanged = "UNCHANGED"
+	importConflict  = "CONFLICT"
+	importSkip      = "SKIP"
+)
+
+// importEntry is a host read from a hosts file and what importing it will do, Original is the stored host an
+// update changes
+type importEntry struct {
+	Line     int
+	Action   string
+	Host     Host
+	Original *Host
+	Detail   string
+}
+
+// localHostsEntry reports why a hosts file entry is one of the loopback, multicast or localhost entries every
+// hosts file carries, like those in header.txt, or returns blank when it is not
+func localHostsEntry(ip net.IP, name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case ip.IsLoopback():
+		return "loopback address"
+	case ip.IsUnspecified(), ip.IsMulticast(), ip.Equal(net.IPv4bcast), ip.Equal(net.ParseIP("fe00::")):
+		return "special address"
+	case strings.HasPrefix(name, "localhost"), strings.HasPrefix(name, "ip6-"), name == "broadcasthost":
+		return "local name"
+	}
+	return ""
+}
+
+// parseHostsFile reads the entries of a hosts file in to network, the first name of each line is the fqdn and the
+// rest are aliases. An ipv4 and an ipv6 line for the same fqdn are merged in to one host
+func parseHostsFile(r io.Reader, network string) ([]importEntry, error) {
+	var entries []importEntry
+	byname := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			entries = append(entries, importEntry{Line: line, Action: importSkip, Host: Host{IPv4: fields[0]}, Detail: "no host name"})
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		host := Host{Network: network, Hostname: fields[1], Aliases: mergeAliases(fields[2:])}
+		if ip != nil && ip.To4() != nil {
+			host.IPv4 = fields[0]
+		} else {
+			host.IPv6 = fields[0]
+		}
+		if ip == nil {
+			entries = append(entries, importEntry{Line: line, Action: importSkip, Host: host, Detail: "not an ip address"})
+			continue
+		}
+		if reason := localHostsEntry(ip, host.Hostname); reason != "" {
+			entries = append(entries, importEntry{Line: line, Action: importSkip, Host: host, Detail: reason})
+			continue
+		}
+
+		previous, seen := byname[strings.ToLower(host.Hostname)]
+		if !seen {
+			byname[strings.ToLower(host.Hostname)] = len(entries)
+			entries = append(entries, importEntry{Line: line, Host: host})
+			continue
+		}
+		merged := &entries[previous].Host
+		switch {
+		case host.IPv4 != "" && merged.IPv4 == "":
+			merged.IPv4 = host.IPv4
+		case host.IPv6 != "" && merged.IPv6 == "":
+			merged.IPv6 = host.IPv6
+		default:
+			entries = append(entries, importEntry{Line: line, Action: importConflict, Host: host, Detail: fmt.Sprintf("%s is already on line %d", host.Hostname, entries[previous].Line)})
+			continue
+		}
+		merged.Aliases = mergeAliases(append(merged.Aliases, host.Aliases...))
+	}
+	return entries, scanner.Err()
+}
+
+// hostChanges describes the differences between a stored host and the host it is being updated to
+func hostChanges(original Host, host Host) string {
+	var changes []string
+	if original.IPv4 != host.IPv4 {
+		changes = append(changes, "ipv4 "+original.IPv4+" -> "+host.IPv4)
+	}
+	if original.IPv6 != host.IPv6 {
+		changes = append(changes, "ipv6 "+original.IPv6+" -> "+host.IPv6)
+	}
+	if strings.Join(original.Aliases, " ") != strings.Join(host.Aliases, " ") {
+		changes = append(changes, "aliases "+strings.Join(original.Aliases, " ")+" -> "+strings.Join(host.Aliases, " "))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// planHostsImport works out whether each entry creates a host, updates the host with the same fqdn in the
+// network, leaves it unchanged or conflicts with another host. Updates keep the existing aliases, mac and ipv6
+// when the file does not give one. New hosts need an ipv4 address, so ipv6 only entries are skipped
+func planHostsImport(entries []importEntry) error {
+	claimed := make(map[string]int)
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Action != "" {
+			continue
+		}
+		host := entry.Host
+		original, err := store.GetHost(host.Hostname, host.Network)
+		switch {
+		case err == ErrNotFound && host.IPv4 == "":
+			entry.Action, entry.Detail = importSkip, "no ipv4 address, hosts without one are not supported"
+			continue
+		case err == ErrNotFound:
+			host.Status = hostActive
+			host = normaliseAliases(host)
+			err = validateHost(host, nil)
+			entry.Action = importCreate
+		case err != nil:
+			return err
+		default:
+			updated := original
+			if host.IPv4 != "" {
+				updated.IPv4 = host.IPv4
+			}
+			if host.IPv6 != "" {
+				updated.IPv6 = host.IPv6
+			}
+			updated.Aliases = mergeAliases(append(original.Aliases, host.Aliases...))
+			updated = normaliseAliases(updated)
+			host = updated
+			entry.Original = &original
+			if sameHostDetails(original, updated) {
+				entry.Action = importUnchanged
+			} else {
+				err = validateHost(updated, &original)
+				entry.Action, entry.Detail = importUpdate, hostChanges(original, updated)
+			}
+		}
+
+		// addresses used twice within the file are not caught by the database checks
+		for _, address := range []string{host.IPv4, host.IPv6} {
+			if line, ok := claimed[strings.ToLower(address)]; ok && address != "" && err == nil {
+				err = ConflictError{address + " is already used on line " + fmt.Sprint(line)}
+			}
+		}
+		if err != nil {
+			if !isUserError(err) {
+				return err
+			}
+			entry.Action, entry.Detail = importConflict, err.Error()
+			continue
+		}
+		for _, address := range []string{host.IPv4, host.IPv6} {
+			if address != "" {
+				claimed[strings.ToLower(address)] = entry.Line
+			}
+		}
+		entry.Host = host
+	}
+	return nil
+}
+
+// importHostsFile reads a hosts file in to network and prints what importing each entry does. Nothing is changed
+// unless commit is true, conflicting entries are never imported and are reported in the returned error. The
+// entries are imported in one transaction, so either all of them are imported or none are
+func importHostsFile(filename string, network string, commit bool) error {
+	if network == "" {
+		return ValidationError{"--network is required"}
+	}
+	if _, err := store.GetNetwork(network); err == ErrNotFound {
+		return ValidationError{"network does not exist: " + network}
+	} else if err != nil {
+		return err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	entries, err := parseHostsFile(file, network)
+	if err != nil {
+		return err
+	}
+	if err := planHostsImport(entries); err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		counts[entry.Action]++
+		var addresses []string
+		for _, address := range []string{entry.Host.IPv4, entry.Host.IPv6} {
+			if address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+		report := fmt.Sprintf("%-9s  line %-5d  %-15s  %s", entry.Action, entry.Line, strings.Join(addresses, ","), strings.Join(append([]string{entry.Host.Hostname}, entry.Host.Aliases...), "  "))
+		if entry.Detail != "" {
+			report = report + "  (" + entry.Detail + ")"
+		}
+		fmt.Println(strings.TrimRight(report, " "))
+	}
+	fmt.Printf("%d to create, %d to update, %d unchanged, %d conflicts, %d skipped\n", counts[importCreate], counts[importUpdate], counts[importUnchanged], counts[importConflict], counts[importSkip])
+
+	if !commit {
+		fmt.Println("dry run, nothing was imported. Run again with --commit to import")
+	} else {
+		audit := cliAudit()
+		err = store.InTransaction(func(txstore Store) error {
+			for i := range entries {
+				entry := &entries[i]
+				var err error
+				switch entry.Action {
+				case importCreate:
+					if err = txstore.CreateHost(entry.Host); err == nil {
+						err = recordHostChange(txstore, audit, auditAddHost, nil, &entry.Host)
+					}
+				case importUpdate:
+					if err = txstore.UpdateHost(entry.Original.Hostname, entry.Original.Network, entry.Host); err == nil {
+						err = recordHostChange(txstore, audit, auditUpdateHost, entry.Original, &entry.Host)
+					}
+				default:
+					continue
+				}
+				if err != nil {
+					return fmt.Errorf("line %d: cannot import %s: %s", entry.Line, entry.Host.Hostname, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("nothing was imported: %s", err)
+		}
+		fmt.Printf("imported %d new and %d updated hosts\n", counts[importCreate], counts[importUpdate])
+	}
+	if counts[importConflict] > 0 {
+		return ConflictError{fmt.Sprintf("%d entries conflict with existing hosts or each other and were not imported", counts[importConflict])}
+	}
+	return nil
+}
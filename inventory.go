@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ansibleHostVars are the variables ansible is given for each host
+type ansibleHostVars struct {
+	AnsibleHost string   `json:"ansible_host,omitempty"`
+	IPv4        string   `json:"ipv4"`
+	IPv6        string   `json:"ipv6"`
+	MAC         string   `json:"mac"`
+	Aliases     []string `json:"aliases"`
+	Network     string   `json:"network"`
+}
+
+// ansibleGroup is a group of an ansible dynamic inventory
+type ansibleGroup struct {
+	Hosts    []string          `json:"hosts,omitempty"`
+	Vars     map[string]string `json:"vars,omitempty"`
+	Children []string          `json:"children,omitempty"`
+}
+
+var invalidGroupCharacters = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// ansibleGroupName turns the description of a network, or its name when it has no description, in to a valid
+// ansible group name
+func ansibleGroupName(network SingleNetwork) string {
+	name := network.Description
+	if strings.TrimSpace(name) == "" {
+		name = network.Network
+	}
+	name = strings.Trim(invalidGroupCharacters.ReplaceAllString(name, "_"), "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "network_" + name
+	}
+	return name
+}
+
+// ansibleVars returns the variables of a host, ansible connects to its ipv4 address or otherwise its ipv6 address
+func ansibleVars(host Host) ansibleHostVars {
+	vars := ansibleHostVars{IPv4: host.IPv4, IPv6: host.IPv6, MAC: host.MAC, Aliases: host.Aliases, Network: host.Network}
+	if vars.Aliases == nil {
+		vars.Aliases = []string{}
+	}
+	if net.ParseIP(host.IPv4) != nil {
+		vars.AnsibleHost = host.IPv4
+	} else if net.ParseIP(host.IPv6) != nil {
+		vars.AnsibleHost = host.IPv6
+	}
+	return vars
+}
+
+// ansibleInventory returns the --list form of an ansible dynamic inventory of the active hosts, or only those
+// within network. Each network is a group, and a host in several networks takes its variables from the first of them
+func ansibleInventory(network string) (map[string]interface{}, error) {
+	mynetworks, err := store.ListNetworks(NetworkFilter{Network: network})
+	if err != nil {
+		return nil, err
+	}
+	myhosts, err := store.ListHosts(HostFilter{Network: network, Status: hostActive})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*ansibleGroup)
+	hostvars := make(map[string]ansibleHostVars)
+	grouped := hostsByNetwork(myhosts)
+	for _, mynetwork := range mynetworks {
+		name := ansibleGroupName(mynetwork)
+		group, ok := groups[name]
+		if !ok {
+			group = &ansibleGroup{Vars: map[string]string{"network": mynetwork.Network, "cidr": mynetwork.CIDR}}
+			groups[name] = group
+		}
+		for _, host := range grouped[strings.ToLower(mynetwork.Network)] {
+			group.Hosts = append(group.Hosts, host.Hostname)
+			if _, ok := hostvars[host.Hostname]; !ok {
+				hostvars[host.Hostname] = ansibleVars(host)
+			}
+		}
+	}
+
+	inventory := map[string]interface{}{"_meta": map[string]interface{}{"hostvars": hostvars}}
+	all := &ansibleGroup{Children: []string{}}
+	for name, group := range groups {
+		inventory[name] = group
+		all.Children = append(all.Children, name)
+	}
+	sort.Strings(all.Children)
+	inventory["all"] = all
+	return inventory, nil
+}
+
+// ansibleHost returns the --host form of an ansible dynamic inventory, the variables of a host or nothing when
+// the host is not in the inventory
+func ansibleHost(fqdn string, network string) (map[string]interface{}, error) {
+	myhosts, err := store.ListHosts(HostFilter{FQDN: fqdn, Network: network, Status: hostActive})
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]interface{})
+	if len(myhosts) == 0 {
+		return vars, nil
+	}
+	c, err := json.Marshal(ansibleVars(myhosts[0]))
+	if err != nil {
+		return nil, err
+	}
+	return vars, json.Unmarshal(c, &vars)
+}
+
+// printAnsibleInventory prints the --list or --host form of an ansible dynamic inventory
+func printAnsibleInventory(list bool, fqdn string, network string) error {
+	var inventory map[string]interface{}
+	var err error
+	switch {
+	case fqdn != "":
+		inventory, err = ansibleHost(fqdn, network)
+	case list:
+		inventory, err = ansibleInventory(network)
+	default:
+		return ValidationError{"--list or --host is required"}
+	}
+	if err != nil {
+		return err
+	}
+	c, err := json.Marshal(inventory)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", c)
+	return nil
+}
+
+// handlerAnsibleInventory handles GET /inventory/ansible, ?host=FQDN returns the variables of a single host
+func handlerAnsibleInventory(w http.ResponseWriter, r *http.Request) {
+	network, _ := restrictNetwork(r, "")
+	var inventory map[string]interface{}
+	var err error
+	if fqdn := r.URL.Query().Get("host"); fqdn != "" {
+		inventory, err = ansibleHost(fqdn, network)
+	} else {
+		inventory, err = ansibleInventory(network)
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, inventory)
+}
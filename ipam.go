@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/spf13/viper"
+	"net"
+	"strings"
+)
+
+// ErrNoFreeIP is returned when every usable address within a network is taken
+var ErrNoFreeIP = errors.New("no free ip addresses left in network")
+
+// ParseNetworkCIDR parses the CIDR of a network, shortened forms like 10.0.1/24 are padded out to 10.0.1.0/24
+func ParseNetworkCIDR(cidr string) (*net.IPNet, error) {
+	parts := strings.SplitN(strings.TrimSpace(cidr), "/", 2)
+	if len(parts) == 2 && !strings.Contains(parts[0], ":") {
+		for strings.Count(parts[0], ".") < 3 {
+			parts[0] = parts[0] + ".0"
+		}
+		cidr = parts[0] + "/" + parts[1]
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return ipnet, nil
+}
+
+// ipToInt converts an ipv4 address in to a number so ranges can be walked
+func ipToInt(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+// intToIP converts a number back in to an ipv4 address
+func intToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// parseIPRange turns a reserved range in to its first and last ipv4 address, ranges can be
+// a single address (10.0.1.1), a span (10.0.1.1-10.0.1.20) or a cidr (10.0.1.0/28)
+func parseIPRange(iprange string) (uint32, uint32, error) {
+	iprange = strings.TrimSpace(iprange)
+	if strings.Contains(iprange, "/") {
+		ipnet, err := ParseNetworkCIDR(iprange)
+		if err != nil || ipnet.IP.To4() == nil {
+			return 0, 0, errors.New("invalid reserved range " + iprange)
+		}
+		first := ipToInt(ipnet.IP)
+		ones, bits := ipnet.Mask.Size()
+		return first, first | (1<<uint(bits-ones) - 1), nil
+	}
+	ends := strings.SplitN(iprange, "-", 2)
+	if len(ends) == 1 {
+		ends = append(ends, ends[0])
+	}
+	first := net.ParseIP(strings.TrimSpace(ends[0])).To4()
+	last := net.ParseIP(strings.TrimSpace(ends[1])).To4()
+	if first == nil || last == nil {
+		return 0, 0, errors.New("invalid reserved range " + iprange)
+	}
+	return ipToInt(first), ipToInt(last), nil
+}
+
+// NextFreeIP returns the lowest ipv4 address within cidr that is not the network or broadcast
+// address, is not within a reserved range and is not already used
+func NextFreeIP(cidr string, used []string, reserved []string) (string, error) {
+	ipnet, err := ParseNetworkCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	if ipnet.IP.To4() == nil {
+		return "", errors.New("only ipv4 networks can allocate addresses: " + cidr)
+	}
+
+	taken := make(map[uint32]bool)
+	for _, ip := range used {
+		if parsed := net.ParseIP(ip).To4(); parsed != nil {
+			taken[ipToInt(parsed)] = true
+		}
+	}
+
+	type span struct{ first, last uint32 }
+	var spans []span
+	for _, iprange := range reserved {
+		if strings.TrimSpace(iprange) == "" {
+			continue
+		}
+		first, last, err := parseIPRange(iprange)
+		if err != nil {
+			return "", err
+		}
+		spans = append(spans, span{first, last})
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	first := ipToInt(ipnet.IP)
+	last := first | (1<<uint(bits-ones) - 1)
+	// /31 and /32 networks have no network or broadcast address to skip
+	if bits-ones > 1 {
+		first++
+		last--
+	}
+
+	for candidate := first; candidate <= last && candidate >= first; candidate++ {
+		if taken[candidate] {
+			continue
+		}
+		reservedip := false
+		for _, s := range spans {
+			if candidate >= s.first && candidate <= s.last {
+				reservedip = true
+				break
+			}
+		}
+		if !reservedip {
+			return intToIP(candidate).String(), nil
+		}
+	}
+	return "", ErrNoFreeIP
+}
+
+// IPInCIDR reports whether an ip address falls inside a cidr
+func IPInCIDR(ip string, cidr string) (bool, error) {
+	ipnet, err := ParseNetworkCIDR(cidr)
+	if err != nil {
+		return false, err
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false, errors.New("invalid ip address " + ip)
+	}
+	return ipnet.Contains(parsed), nil
+}
+
+// checkHostInNetwork makes sure an ipv4 address falls inside the cidr of a network, when
+// EnforceCIDR is false addresses outside the cidr are only warned about so legacy data still loads
+func checkHostInNetwork(ip string, network string) error {
+	mynetwork, err := store.GetNetwork(network)
+	if err != nil {
+		return errors.New("cannot find network " + network + ": " + err.Error())
+	}
+	inside, err := IPInCIDR(ip, mynetwork.CIDR)
+	if err != nil {
+		return errors.New("cannot check ip against network " + network + " cidr " + mynetwork.CIDR + ": " + err.Error())
+	}
+	if !inside {
+		err = errors.New("ip " + ip + " is outside network " + network + " (" + mynetwork.CIDR + ")")
+		if viper.GetBool("EnforceCIDR") {
+			return err
+		}
+		showerror("EnforceCIDR is false, allowing", err, "warn")
+	}
+	return nil
+}
+
+// checkDuplicates makes sure a host does not share an ipv4, ipv6 or mac address with another host,
+// excluding the host being updated. Clashes are only allowed when the host being added or updated has
+// AllowDuplicate set, the flag on the other host only covers that host
+func checkDuplicates(host Host, excludefqdn string, excludenetwork string) error {
+	duplicates, err := store.FindDuplicates(host, excludefqdn, excludenetwork)
+	if err != nil {
+		return err
+	}
+	var clashes []string
+	for _, duplicate := range duplicates {
+		var fields []string
+		if host.IPv4 != "" && strings.EqualFold(duplicate.IPv4, host.IPv4) {
+			fields = append(fields, "ipv4 "+host.IPv4)
+		}
+		if host.IPv6 != "" && strings.EqualFold(duplicate.IPv6, host.IPv6) {
+			fields = append(fields, "ipv6 "+host.IPv6)
+		}
+		if host.MAC != "" && strings.EqualFold(duplicate.MAC, host.MAC) {
+			fields = append(fields, "mac "+host.MAC)
+		}
+		if host.AllowDuplicate {
+			showerror("allowing duplicate", errors.New(strings.Join(fields, ", ")+" also used by "+duplicate.Hostname+" / "+duplicate.Network), "warn")
+			continue
+		}
+		clashes = append(clashes, strings.Join(fields, ", ")+" already used by "+duplicate.Hostname+" / "+duplicate.Network)
+	}
+	if len(clashes) > 0 {
+		return ConflictError{strings.Join(clashes, "; ")}
+	}
+	return nil
+}
+
+// nextFreeIPInNetwork finds the next free address within a network stored in the database,
+// addresses used by any host are skipped, not just those of hosts within the network
+func nextFreeIPInNetwork(network string) (string, error) {
+	mynetwork, err := store.GetNetwork(network)
+	if err != nil {
+		return "", err
+	}
+	myhosts, err := store.ListHosts(HostFilter{})
+	if err != nil {
+		return "", err
+	}
+	var used []string
+	for _, host := range myhosts {
+		used = append(used, host.IPv4)
+	}
+	return NextFreeIP(mynetwork.CIDR, used, viper.GetStringSlice("ReservedRanges"))
+}
@@ -1,8 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestBreakIp(t *testing.T) {
@@ -40,21 +52,174 @@ func TestPadLeft(t *testing.T) {
 	//}
 }
 
-func TestParseSql(t *testing.T) {
-	var validtests = []string{"select * from hosts", "select * from networks", "select * from hosts where fqdn like 'server.example.com'", "select * from hosts where network like '192.168.1'", "select * from networks where network like '192.168.1'", "select * from hosts where ipaddress like '192.168.1.1'", "select * from hosts where mac like 'de:ad:be:ef:ca:fe'"}
-	//var invalidtests = []string{"random junk", "more junk", "even more junk"}
-	fmt.Println("Testing for good SQL queries:")
-	for i, v := range validtests {
-		if !ParseSql(v) {
-			t.Error("Test ", i, ": Expected: True  Actual: ", v)
+// newTestStore opens a blank database for testing against, sqlite3 is used as an embedded
+// stand-in unless NARCOTK_TEST_DATABASETYPE and NARCOTK_TEST_DATABASE point at a scratch database
+func newTestStore(t *testing.T) Store {
+	databaseType := os.Getenv("NARCOTK_TEST_DATABASETYPE")
+	database := os.Getenv("NARCOTK_TEST_DATABASE")
+	if databaseType == "" {
+		databaseType = "sqlite3"
+		database = ":memory:"
+	}
+	testdb, err := sql.Open(databaseType, database)
+	if err != nil {
+		t.Fatal("cannot open test database: ", err)
+	}
+	testdb.SetMaxOpenConns(1)
+	for _, table := range []string{"hosts", "networks", "schema_version", "aliases", "api_tokens", "registration_keys", "audit_log"} {
+		testdb.Exec("DROP TABLE IF EXISTS " + table)
+	}
+	if err := createSchema(testdb, databaseType); err != nil {
+		t.Fatal("cannot create test tables: ", err)
+	}
+	return NewSQLStore(testdb, databaseType)
+}
+
+func TestRebind(t *testing.T) {
+	var tests = []string{"select * from hosts where fqdn like ? and network like ?", "update hosts set fqdn = '?' where fqdn = ?"}
+	var expectedresults = []string{"select * from hosts where fqdn like $1 and network like $2", "update hosts set fqdn = '?' where fqdn = $1"}
+	for i, v := range tests {
+		if rebind("postgres", v) != expectedresults[i] {
+			t.Error("Test ", i, ": Expected: ", expectedresults[i], "  Actual: ", rebind("postgres", v))
+		}
+		if rebind("sqlite3", v) != v {
+			t.Error("Test ", i, ": Expected: ", v, "  Actual: ", rebind("sqlite3", v))
+		}
+	}
+}
+
+func TestStoreHosts(t *testing.T) {
+	teststore := newTestStore(t)
+	var tests = []string{"o'brien.example.com", "x' or '1'='1", "server1.example.com"}
+	for i, v := range tests {
+		if err := teststore.CreateHost(Host{Network: "192.168.1", IPv4: "192.168.1." + fmt.Sprint(i+1), Hostname: v}); err != nil {
+			t.Error("Test ", i, ": CreateHost failed: ", err)
+		}
+	}
+	for i, v := range tests {
+		myhosts, err := teststore.ListHosts(HostFilter{FQDN: v})
+		if err != nil || len(myhosts) != 1 || myhosts[0].Hostname != v {
+			t.Error("Test ", i, ": Expected: ", v, "  Actual: ", myhosts, err)
+		}
+	}
+	if err := teststore.DeleteHost("x' or '1'='1", "192.168.1"); err != nil {
+		t.Error("DeleteHost failed: ", err)
+	}
+	if myhosts, _ := teststore.ListHosts(HostFilter{}); len(myhosts) != 2 {
+		t.Error("Expected: 2 hosts after delete  Actual: ", len(myhosts))
+	}
+	if myhosts, _ := teststore.ListHosts(HostFilter{FQDN: "SERVER1.Example.COM"}); len(myhosts) != 1 {
+		t.Error("Expected: case-insensitive match on fqdn  Actual: ", myhosts)
+	}
+	if myhosts, _ := teststore.ListHosts(HostFilter{FQDN: "%.example.com"}); len(myhosts) != 0 {
+		t.Error("Expected: no wildcards in exact matches  Actual: ", myhosts)
+	}
+	if myhosts, _ := teststore.ListHosts(HostFilter{FQDNLike: "%.EXAMPLE.com", NetworkLike: "192.168._"}); len(myhosts) != 2 {
+		t.Error("Expected: 2 hosts matching like patterns  Actual: ", myhosts)
+	}
+	if err := teststore.CreateHost(Host{Network: "192.168.2", IPv4: "192.168.2.252", Hostname: "loadbalancer.narco.tk", Aliases: []string{"loadbalancer", "ssh.narco.tk", "ssh", "jump.narco.tk", "jump"}}); err != nil {
+		t.Error("CreateHost with aliases failed: ", err)
+	}
+	if lb, err := teststore.GetHost("loadbalancer.narco.tk", "192.168.2"); err != nil || len(lb.Aliases) != 5 || lb.Short4 != "jump.narco.tk" {
+		t.Error("Expected: 5 aliases with Short4 jump.narco.tk  Actual: ", lb, err)
+	}
+	if err := teststore.UpdateHost("loadbalancer.narco.tk", "192.168.2", Host{Network: "192.168.2", IPv4: "192.168.2.252", Hostname: "lb.narco.tk", Short1: "lb"}); err != nil {
+		t.Error("UpdateHost with legacy short1 failed: ", err)
+	}
+	if lb, err := teststore.GetHost("lb.narco.tk", "192.168.2"); err != nil || len(lb.Aliases) != 1 || lb.Aliases[0] != "lb" {
+		t.Error("Expected: aliases replaced with [lb]  Actual: ", lb, err)
+	}
+	if duplicates, err := teststore.FindDuplicates(Host{IPv4: "192.168.1.1", MAC: "de:ad:be:ef:ca:fe"}, "", ""); err != nil || len(duplicates) != 1 {
+		t.Error("Expected: 1 duplicate of 192.168.1.1  Actual: ", duplicates, err)
+	}
+	if duplicates, err := teststore.FindDuplicates(Host{IPv4: "192.168.1.1"}, "o'brien.example.com", "192.168.1"); err != nil || len(duplicates) != 0 {
+		t.Error("Expected: no duplicates when excluding the host itself  Actual: ", duplicates, err)
+	}
+	if err := teststore.CreateHost(Host{Network: "192.168.1", IPv4: "192.168.1.1", Hostname: "clash.example.com"}); err == nil {
+		t.Error("Expected: unique index to reject a duplicate ipv4  Actual: no error")
+	}
+	if err := teststore.CreateHost(Host{Network: "192.168.1", IPv4: "192.168.1.1", Hostname: "vip.example.com", AllowDuplicate: true}); err != nil {
+		t.Error("Expected: AllowDuplicate to permit a shared ipv4  Actual: ", err)
+	}
+	if _, err := teststore.GetHost("missing.example.com", "192.168.1"); err != ErrNotFound {
+		t.Error("Expected: ErrNotFound  Actual: ", err)
+	}
+}
+
+func TestCheckDuplicates(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	// legacy hosts sharing an address are marked allowduplicate by the migration
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.5", Hostname: "legacy1.example.com", AllowDuplicate: true, Status: hostActive})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.5", Hostname: "legacy2.example.com", AllowDuplicate: true, Status: hostActive})
+
+	if _, err := addHost(cliAudit(), Host{Network: "10.0.1", IPv4: "10.0.1.5", Hostname: "new.example.com"}); statusForError(err) != http.StatusConflict {
+		t.Error("Expected: sharing the address of a flagged host without --allow-duplicate to conflict  Actual: ", err)
+	}
+	if _, err := addHost(cliAudit(), Host{Network: "10.0.1", IPv4: "10.0.1.5", Hostname: "vip.example.com", AllowDuplicate: true}); err != nil {
+		t.Error("Expected: --allow-duplicate to permit the shared address  Actual: ", err)
+	}
+	legacy1, _ := store.GetHost("legacy1.example.com", "10.0.1")
+	legacy1.Aliases = []string{"legacy"}
+	if _, err := updateHost(cliAudit(), legacy1.Hostname, legacy1.Network, legacy1); err != nil {
+		t.Error("Expected: a flagged legacy host to still be updatable  Actual: ", err)
+	}
+}
+
+func TestMergeAliases(t *testing.T) {
+	var tests = [][]string{mergeAliases(nil), mergeAliases([]string{"a", "b"}), mergeAliases([]string{"a", "b"}, "", "c"), mergeAliases(nil, "a", "", "b", ""), mergeAliases([]string{"a", " A ", "", "b"})}
+	var expectedresults = []string{"", "a b", "a c", "a b", "a b"}
+	for i, v := range tests {
+		if strings.Join(v, " ") != expectedresults[i] || v == nil {
+			t.Error("Test ", i, ": Expected: ", expectedresults[i], "  Actual: ", v)
+		}
+	}
+	c, _ := json.Marshal(normaliseAliases(Host{}))
+	if !strings.Contains(string(c), `"Aliases":[]`) {
+		t.Error("Expected: Aliases:[] in json  Actual: ", string(c))
+	}
+}
+
+func TestParseNetworkCIDR(t *testing.T) {
+	var tests = []string{"192.168.1.0/24", "10.0.1/24", "10/8", "192.168.1.77/24"}
+	var expectedresults = []string{"192.168.1.0/24", "10.0.1.0/24", "10.0.0.0/8", "192.168.1.0/24"}
+	for i, v := range tests {
+		ipnet, err := ParseNetworkCIDR(v)
+		if err != nil || ipnet.String() != expectedresults[i] {
+			t.Error("Test ", i, ": Expected: ", expectedresults[i], "  Actual: ", ipnet, err)
+		}
+	}
+}
+
+func TestIPInCIDR(t *testing.T) {
+	var tests = []string{"192.168.1.7", "10.0.5.7", "192.168.1.255", "rubbish"}
+	var expectedresults = []bool{true, false, true, false}
+	for i, v := range tests {
+		if inside, _ := IPInCIDR(v, "192.168.1.0/24"); inside != expectedresults[i] {
+			t.Error("Test ", i, ": Expected: ", expectedresults[i], "  Actual: ", inside)
+		}
+	}
+}
+
+func TestNextFreeIP(t *testing.T) {
+	var tests = []struct {
+		cidr     string
+		used     []string
+		reserved []string
+		expected string
+	}{
+		{"192.168.1.0/24", nil, nil, "192.168.1.1"},
+		{"192.168.1.0/24", []string{"192.168.1.1", "192.168.1.2", "10.0.0.3"}, nil, "192.168.1.3"},
+		{"192.168.1.0/24", []string{"192.168.1.11"}, []string{"192.168.1.1-192.168.1.10"}, "192.168.1.12"},
+		{"10.0.1/24", nil, []string{"10.0.1.0/28", "10.0.1.16"}, "10.0.1.17"},
+		{"192.168.1.0/30", []string{"192.168.1.1", "192.168.1.2"}, nil, ""},
+	}
+	for i, v := range tests {
+		ip, err := NextFreeIP(v.cidr, v.used, v.reserved)
+		if ip != v.expected || (v.expected == "" && err != ErrNoFreeIP) {
+			t.Error("Test ", i, ": Expected: ", v.expected, "  Actual: ", ip, err)
 		}
 	}
-	//fmt.Println("Testing for bad SQL queries:")
-	//for i, v := range invalidtests {
-	//	if !ParseSql(v) {
-	//		t.Error("Test ", i, ": Expected: True  Actual: ", v)
-	//	}
-	//}
 }
 
 func TestPrepareMac(t *testing.T) {
@@ -82,3 +247,1277 @@ func TestValidIP(t *testing.T) {
 	//	}
 	//}
 }
+
+func TestMigrateLegacySchema(t *testing.T) {
+	testdb, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal("cannot open test database: ", err)
+	}
+	testdb.SetMaxOpenConns(1)
+	for _, sqlquery := range []string{
+		"CREATE TABLE hosts (hostid text PRIMARY KEY, network text NOT NULL, ipsuffix integer NOT NULL, ipaddress text NOT NULL, fqdn text NOT NULL, short1 text NOT NULL DEFAULT '', short2 text NOT NULL DEFAULT '', short3 text NOT NULL DEFAULT '', short4 text NOT NULL DEFAULT '', mac TEXT DEFAULT '')",
+		"CREATE TABLE networks (network text PRIMARY KEY, cidr text NOT NULL, description text NOT NULL DEFAULT '')",
+		"insert into hosts values ('192.168.1.2', '192.168.1', 2, '192.168.1.2', 'n1.narco.tk', 'n1', '', '', '', 'DE:AD:BE:EF:CA:FE')",
+		"insert into hosts values ('192.168.1.3', '192.168.1', 3, '', 'n2.narco.tk', 'n2', '', '', '', NULL)",
+	} {
+		if _, err := testdb.Exec(sqlquery); err != nil {
+			t.Fatal("cannot create legacy tables: ", err)
+		}
+	}
+	if err := checkSchemaVersion(testdb); err == nil {
+		t.Error("Expected: legacy database to need migrating  Actual: no error")
+	}
+	if err := migrateDatabase(testdb, "sqlite3"); err != nil {
+		t.Fatal("migration failed: ", err)
+	}
+	if err := checkSchemaVersion(testdb); err != nil {
+		t.Error("Expected: migrated database to be current  Actual: ", err)
+	}
+	myhosts, err := NewSQLStore(testdb, "sqlite3").ListHosts(HostFilter{})
+	if err != nil || len(myhosts) != 2 {
+		t.Fatal("Expected: 2 migrated hosts  Actual: ", myhosts, err)
+	}
+	if myhosts[0].IPv4 != "192.168.1.2" || myhosts[0].MAC != "de:ad:be:ef:ca:fe" || myhosts[1].IPv4 != "192.168.1.3" {
+		t.Error("Expected: ipaddress and ipsuffix converted to ipv4  Actual: ", myhosts)
+	}
+	if err := recordSchemaVersion(testdb, "sqlite3", latestSchemaVersion()+1, "from the future"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSchemaVersion(testdb); err == nil {
+		t.Error("Expected: newer database to be refused  Actual: no error")
+	}
+}
+
+func TestRESTCrud(t *testing.T) {
+	store = newTestStore(t)
+	viper.Set("EnforceCIDR", true)
+	viper.Set("RequireToken", false)
+	defer viper.Set("RequireToken", true)
+	router := newRouter()
+
+	var tests = []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"POST", "/networks", `{"Network":"10.0.1","CIDR":"10.0.1.0/24","Description":"test"}`, http.StatusCreated},
+		{"POST", "/networks", `{"Network":"10.0.1","CIDR":"10.0.1.0/24"}`, http.StatusConflict},
+		{"POST", "/networks", `{"Network":"10.0.2","CIDR":"nonsense"}`, http.StatusUnprocessableEntity},
+		{"POST", "/hosts", `{"Network":"10.0.1","IPv4":"10.0.1.5","Hostname":"server1.example.com","Aliases":["server1"]}`, http.StatusCreated},
+		{"POST", "/hosts", `{"Network":"10.0.1","IPv4":"10.0.1.5","Hostname":"server2.example.com"}`, http.StatusConflict},
+		{"POST", "/hosts", `{"Network":"10.0.1","IPv4":"10.0.9.5","Hostname":"server3.example.com"}`, http.StatusUnprocessableEntity},
+		{"POST", "/hosts", `{"Network":"10.0.9","IPv4":"10.0.9.5","Hostname":"server3.example.com"}`, http.StatusUnprocessableEntity},
+		{"POST", "/hosts", `{"Network":`, http.StatusBadRequest},
+		{"PATCH", "/host/server1.example.com", `{"MAC":"DEADBEEFCAFE"}`, http.StatusOK},
+		{"PATCH", "/host/server1.example.com", `{"MAC":"nonsense"}`, http.StatusUnprocessableEntity},
+		{"PUT", "/host/server1.example.com?network=10.0.1", `{"IPv4":"10.0.1.6","Aliases":["s1","s1a"]}`, http.StatusOK},
+		{"PUT", "/host/missing.example.com", `{"IPv4":"10.0.1.7"}`, http.StatusNotFound},
+		{"PATCH", "/network/10.0.1", `{"Description":"changed"}`, http.StatusOK},
+		{"DELETE", "/network/10.0.1", ``, http.StatusConflict},
+		{"DELETE", "/host/server1.example.com", ``, http.StatusNoContent},
+		{"DELETE", "/host/server1.example.com", ``, http.StatusNotFound},
+		{"DELETE", "/network/10.0.1", ``, http.StatusNoContent},
+	}
+	for i, v := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(v.method, v.path, strings.NewReader(v.body)))
+		if recorder.Code != v.status {
+			t.Error("Test ", i, ": Expected: ", v.status, "  Actual: ", recorder.Code, " ", recorder.Body.String())
+		}
+		var host Host
+		json.Unmarshal(recorder.Body.Bytes(), &host)
+		// patch only changes the fields passed while put replaces the whole host
+		if i == 8 && (host.IPv4 != "10.0.1.5" || host.MAC != "de:ad:be:ef:ca:fe" || strings.Join(host.Aliases, " ") != "server1") {
+			t.Error("Test ", i, ": Expected: 10.0.1.5 de:ad:be:ef:ca:fe [server1]  Actual: ", host.IPv4, " ", host.MAC, " ", host.Aliases)
+		}
+		if i == 10 && (host.IPv4 != "10.0.1.6" || host.MAC != "" || strings.Join(host.Aliases, " ") != "s1 s1a") {
+			t.Error("Test ", i, ": Expected: 10.0.1.6  [s1 s1a]  Actual: ", host.IPv4, " ", host.MAC, " ", host.Aliases)
+		}
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	store.CreateNetwork(SingleNetwork{Network: "10.0.2", CIDR: "10.0.2.0/24"})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.5", Hostname: "server1.example.com"})
+	viper.Set("RequireToken", true)
+	defer viper.Set("RequireToken", true)
+	router := newRouter()
+
+	tokens := make(map[string]string)
+	for _, v := range [][]string{{"reader", "read", "", ""}, {"writer", "write", "", ""}, {"network2", "write", "10.0.2", ""}, {"expired", "admin", "", "2001-01-01"}} {
+		plaintoken, _, err := createToken(v[0], v[1], v[2], v[3])
+		if err != nil {
+			t.Fatal("createToken ", v[0], " failed: ", err)
+		}
+		tokens[v[0]] = plaintoken
+	}
+	if _, _, err := createToken("bad", "read,superuser", "", ""); err == nil {
+		t.Error("Expected: unknown scope to be rejected  Actual: token created")
+	}
+	if _, _, err := createToken("READER", "read", "", ""); statusForError(err) != http.StatusConflict {
+		t.Error("Expected: duplicate token name to conflict  Actual: ", err)
+	}
+
+	var tests = []struct {
+		token  string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"", "GET", "/hosts", ``, http.StatusUnauthorized},
+		{"nonsense", "GET", "/hosts", ``, http.StatusUnauthorized},
+		{"expired", "GET", "/hosts", ``, http.StatusUnauthorized},
+		{"reader", "GET", "/hosts", ``, http.StatusOK},
+		{"reader", "PATCH", "/host/server1.example.com", `{"MAC":"DEADBEEFCAFE"}`, http.StatusForbidden},
+		{"writer", "PATCH", "/host/server1.example.com", `{"MAC":"DEADBEEFCAFE"}`, http.StatusOK},
+		{"network2", "GET", "/hosts/10.0.1", ``, http.StatusForbidden},
+		{"network2", "PATCH", "/host/server1.example.com", `{"MAC":"DEADBEEFCAFF"}`, http.StatusNotFound},
+		{"network2", "POST", "/hosts", `{"Network":"10.0.1","IPv4":"10.0.1.6","Hostname":"server2.example.com"}`, http.StatusForbidden},
+		{"network2", "POST", "/hosts", `{"Network":"10.0.2","IPv4":"10.0.2.6","Hostname":"server2.example.com"}`, http.StatusCreated},
+		{"network2", "PATCH", "/network/10.0.1", `{"Description":"lab"}`, http.StatusForbidden},
+		{"network2", "PATCH", "/network/10.0.9", `{"Description":"lab"}`, http.StatusForbidden},
+		{"network2", "PUT", "/network/10.0.9", `{"CIDR":"10.0.9.0/24"}`, http.StatusForbidden},
+		{"network2", "DELETE", "/network/10.0.9", ``, http.StatusForbidden},
+		{"writer", "PATCH", "/network/10.0.9", `{"Description":"lab"}`, http.StatusNotFound},
+	}
+	for i, v := range tests {
+		request := httptest.NewRequest(v.method, v.path, strings.NewReader(v.body))
+		if v.token != "" {
+			plaintoken, ok := tokens[v.token]
+			if !ok {
+				plaintoken = v.token
+			}
+			request.Header.Set("Authorization", "Bearer "+plaintoken)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != v.status {
+			t.Error("Test ", i, ": Expected: ", v.status, "  Actual: ", recorder.Code, " ", recorder.Body.String())
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/hosts?json=y", nil)
+	request.Header.Set("Authorization", "Bearer "+tokens["network2"])
+	router.ServeHTTP(recorder, request)
+	if strings.Contains(recorder.Body.String(), "server1.example.com") {
+		t.Error("Expected: network restricted token to only list its own hosts  Actual: ", recorder.Body.String())
+	}
+}
+
+func TestRegisterDoesNotExit(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	viper.Set("RegistrationKey", "secret")
+	viper.Set("AllowGETRegistration", true)
+	defer viper.Set("RegistrationKey", "")
+	defer viper.Set("AllowGETRegistration", false)
+	viper.Set("RequireToken", false)
+	defer viper.Set("RequireToken", true)
+	router := newRouter()
+
+	var tests = []struct {
+		query  string
+		status int
+	}{
+		{"key=wrong&fqdn=vm1.example.com&ip=10.0.1.5&nw=10.0.1", http.StatusUnauthorized},
+		{"key=secret&fqdn=vm1.example.com&ip=10.0.1.5&nw=10.0.1&alias=vm1", http.StatusCreated},
+		{"key=secret&fqdn=vm1.example.com&ip=10.0.1.5&nw=10.0.1&alias=vm1", http.StatusConflict},
+		{"key=secret&fqdn=vm2.example.com&ip=10.0.1.5&nw=10.0.1", http.StatusConflict},
+		{"key=secret&fqdn=vm2.example.com&ip=10.0.1.6&nw=10.0.9", http.StatusUnprocessableEntity},
+		{"key=secret&fqdn=vm2.example.com&ip=10.0.1.6", http.StatusUnprocessableEntity},
+		{"key=secret&fqdn=vm2.example.com&ip=10.0.1.6&nw=10.0.1&json=y", http.StatusCreated},
+	}
+	for i, v := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/register?"+v.query, nil))
+		if recorder.Code != v.status {
+			t.Error("Test ", i, ": Expected: ", v.status, "  Actual: ", recorder.Code, " ", recorder.Body.String())
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	var tests = []error{nil, ErrNotFound, ValidationError{"bad"}, ConflictError{"clash"}, ErrNoFreeIP}
+	var expectedresults = []int{exitOK, exitNotFound, exitInvalid, exitConflict, exitError}
+	for i, v := range tests {
+		if exitCode(v) != expectedresults[i] {
+			t.Error("Test ", i, ": Expected: ", expectedresults[i], "  Actual: ", exitCode(v))
+		}
+	}
+}
+
+func TestRegisterUpsert(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	store.CreateNetwork(SingleNetwork{Network: "10.0.2", CIDR: "10.0.2.0/24"})
+	store.CreateHost(Host{Network: "10.0.2", IPv4: "10.0.2.5", Hostname: "other.example.com", MAC: "de:ad:be:ef:00:09", Status: hostActive})
+	viper.Set("RegistrationKey", "secret")
+	viper.Set("AllowGETRegistration", true)
+	defer viper.Set("RegistrationKey", "")
+	defer viper.Set("AllowGETRegistration", false)
+	viper.Set("RequireToken", false)
+	defer viper.Set("RequireToken", true)
+	router := newRouter()
+
+	var tests = []struct {
+		query  string
+		status int
+		result string
+		ip     string
+	}{
+		{"fqdn=iot1.example.com&ip=10.0.1.5&nw=10.0.1&mac=DEADBEEF0001", http.StatusCreated, registrationCreated, "10.0.1.5"},
+		{"fqdn=iot1.example.com&ip=10.0.1.5&nw=10.0.1&mac=DEADBEEF0001", http.StatusOK, registrationUnchanged, "10.0.1.5"},
+		{"fqdn=iot1.example.com&ip=10.0.1.6&nw=10.0.1", http.StatusOK, registrationUpdated, "10.0.1.6"},
+		{"fqdn=iot1-renamed.example.com&ip=10.0.1.7&nw=10.0.1&mac=de:ad:be:ef:00:01", http.StatusOK, registrationUpdated, "10.0.1.7"},
+		{"fqdn=iot2.example.com&ip=10.0.1.7&nw=10.0.1", http.StatusConflict, "", ""},
+		{"fqdn=iot9.example.com&ip=10.0.1.9&nw=10.0.1&mac=DEADBEEF0009", http.StatusConflict, "", ""},
+	}
+	for i, v := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/register?key=secret&upsert=y&json=y&"+v.query, nil))
+		var response registrationResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		if recorder.Code != v.status || response.Result != v.result || response.Host.IPv4 != v.ip {
+			t.Error("Test ", i, ": Expected: ", v.status, " ", v.result, " ", v.ip, "  Actual: ", recorder.Code, " ", recorder.Body.String())
+		}
+	}
+	if myhosts, _ := store.ListHosts(HostFilter{Network: "10.0.1"}); len(myhosts) != 1 || myhosts[0].Hostname != "iot1-renamed.example.com" {
+		t.Error("Expected: iot1 to be renamed by its mac  Actual: ", myhosts)
+	}
+	if other, err := store.GetHost("other.example.com", "10.0.2"); err != nil || other.IPv4 != "10.0.2.5" {
+		t.Error("Expected: a host with the same mac in another network to be left alone  Actual: ", other, " ", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/register?key=secret&fqdn=iot1-renamed.example.com&ip=10.0.1.8&nw=10.0.1", nil))
+	if recorder.Code != http.StatusConflict {
+		t.Error("Expected: registering an existing host without upsert to conflict  Actual: ", recorder.Code)
+	}
+}
+
+func TestSignedRegister(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	viper.Set("RegistrationKey", "secret")
+	defer viper.Set("RegistrationKey", "")
+	viper.Set("RequireToken", false)
+	defer viper.Set("RequireToken", true)
+	router := newRouter()
+
+	now := time.Now().Unix()
+	body := func(fqdn string, ip string, timestamp int64, nonce string) string {
+		return fmt.Sprintf(`{"Hostname":"%s","Network":"10.0.1","IPv4":"%s","Timestamp":%d,"Nonce":"%s"}`, fqdn, ip, timestamp, nonce)
+	}
+	var tests = []struct {
+		body      string
+		signature string
+		status    int
+	}{
+		{body("vm1.example.com", "10.0.1.5", now, "nonce-0001"), "", http.StatusCreated},
+		{body("vm1.example.com", "10.0.1.5", now, "nonce-0001"), "", http.StatusUnauthorized},
+		{body("vm2.example.com", "10.0.1.6", now, "nonce-0002"), "sha256=0000", http.StatusUnauthorized},
+		{body("vm2.example.com", "10.0.1.6", now-3600, "nonce-0003"), "", http.StatusUnauthorized},
+		{body("vm2.example.com", "10.0.1.6", now, "short"), "", http.StatusUnauthorized},
+		{body("vm2.example.com", "10.0.9.6", now, "nonce-0004"), "", http.StatusUnprocessableEntity},
+		{`{"Hostname":`, "", http.StatusBadRequest},
+	}
+	for i, v := range tests {
+		signature := v.signature
+		if signature == "" {
+			signature = signRegistration([]byte(v.body), "secret")
+		}
+		request := httptest.NewRequest("POST", "/register", strings.NewReader(v.body))
+		request.Header.Set(signatureHeader, signature)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != v.status {
+			t.Error("Test ", i, ": Expected: ", v.status, "  Actual: ", recorder.Code, " ", recorder.Body.String())
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/register?key=secret&fqdn=vm3.example.com&ip=10.0.1.7&nw=10.0.1", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Error("Expected: GET registration to be disabled by default  Actual: ", recorder.Code)
+	}
+}
+
+func TestRedactURI(t *testing.T) {
+	var tests = []string{"/register?key=secret&fqdn=vm1.example.com", "/hosts?json=y", "/register?fqdn=vm1.example.com"}
+	var expectedresults = []string{"/register?fqdn=vm1.example.com&key=REDACTED", "/hosts?json=y", "/register?fqdn=vm1.example.com"}
+	for i, v := range tests {
+		if redactURI(v) != expectedresults[i] {
+			t.Error("Test ", i, ": Expected: ", expectedresults[i], "  Actual: ", redactURI(v))
+		}
+	}
+}
+
+func TestRegistrationKeys(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	store.CreateNetwork(SingleNetwork{Network: "10.0.2", CIDR: "10.0.2.0/24"})
+	viper.Set("AllowGETRegistration", true)
+	defer viper.Set("AllowGETRegistration", false)
+	viper.Set("RequireToken", false)
+	defer viper.Set("RequireToken", true)
+	router := newRouter()
+
+	// httptest requests come from 192.0.2.1
+	lab, err := createRegistrationKey("lab", "10.0.1", "192.0.2.0/24", "DE-AD-BE", "", 3)
+	if err != nil {
+		t.Fatal("createRegistrationKey failed: ", err)
+	}
+	elsewhere, _ := createRegistrationKey("elsewhere", "10.0.1,10.0.2", "198.51.100.0/24", "", "", 0)
+	if _, err := createRegistrationKey("bad", "10.0.9", "", "", "", 0); statusForError(err) != http.StatusUnprocessableEntity {
+		t.Error("Expected: unknown network to be rejected  Actual: ", err)
+	}
+	if _, err := createRegistrationKey("bad", "10.0.1", "", "zz:zz", "", 0); statusForError(err) != http.StatusUnprocessableEntity {
+		t.Error("Expected: bad mac prefix to be rejected  Actual: ", err)
+	}
+
+	var tests = []struct {
+		query  string
+		status int
+	}{
+		{"key=" + lab.Key + "&fqdn=vm1.example.com&ip=10.0.1.5&nw=10.0.1&mac=DEADBE000001", http.StatusCreated},
+		{"key=" + lab.Key + "&fqdn=vm1.example.com&ip=10.0.1.5&nw=10.0.1&mac=DEADBE000001", http.StatusConflict},
+		{"key=" + lab.Key + "&fqdn=vm1.example.com&ip=10.0.1.5&nw=10.0.1&mac=DEADBE000001&upsert=y", http.StatusOK},
+		{"key=" + lab.Key + "&fqdn=vm2.example.com&ip=10.0.2.5&nw=10.0.2&mac=DEADBE000002", http.StatusForbidden},
+		{"key=" + lab.Key + "&fqdn=vm2.example.com&ip=10.0.1.6&nw=10.0.1&mac=001122334455", http.StatusForbidden},
+		{"key=" + lab.Key + "&fqdn=vm2.example.com&ip=10.0.1.6&nw=10.0.1", http.StatusForbidden},
+		{"key=" + elsewhere.Key + "&fqdn=vm2.example.com&ip=10.0.1.6&nw=10.0.1", http.StatusForbidden},
+		{"key=nonsense&fqdn=vm2.example.com&ip=10.0.1.6&nw=10.0.1", http.StatusUnauthorized},
+		{"key=" + lab.Key + "&fqdn=vm2.example.com&ip=10.0.1.6&nw=10.0.1&mac=DEADBE000002", http.StatusCreated},
+	}
+	for i, v := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/register?"+v.query, nil))
+		if recorder.Code != v.status {
+			t.Error("Test ", i, ": Expected: ", v.status, "  Actual: ", recorder.Code, " ", recorder.Body.String())
+		}
+	}
+
+	// failed and unchanged registrations do not use up the key, so the third and last use is a signed registration
+	body := fmt.Sprintf(`{"KeyName":"lab","Hostname":"vm3.example.com","Network":"10.0.1","IPv4":"10.0.1.7","MAC":"de:ad:be:00:00:03","Timestamp":%d,"Nonce":"regkey-0001"}`, time.Now().Unix())
+	for i, status := range []int{http.StatusCreated, http.StatusForbidden} {
+		request := httptest.NewRequest("POST", "/register", strings.NewReader(strings.Replace(body, "0001", fmt.Sprint(i+2), 1)))
+		request.Header.Set(signatureHeader, signRegistration([]byte(strings.Replace(body, "0001", fmt.Sprint(i+2), 1)), lab.Key))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != status {
+			t.Error("Signed test ", i, ": Expected: ", status, "  Actual: ", recorder.Code, " ", recorder.Body.String())
+		}
+	}
+	if key, _ := store.GetRegistrationKey("lab"); key.Uses != 3 {
+		t.Error("Expected: 3 uses of lab  Actual: ", key.Uses)
+	}
+}
+
+func TestApproval(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	store.CreateNetwork(SingleNetwork{Network: "10.0.2", CIDR: "10.0.2.0/24", AutoApprove: true})
+	viper.Set("RequireToken", true)
+	defer viper.Set("RequireToken", true)
+	router := newRouter()
+
+	var registrations = []struct {
+		host   Host
+		status string
+	}{
+		{Host{Network: "10.0.1", IPv4: "10.0.1.5", Hostname: "device1.example.com"}, hostPending},
+		{Host{Network: "10.0.2", IPv4: "10.0.2.5", Hostname: "device2.example.com"}, hostActive},
+		{Host{Network: "10.0.1", IPv4: "10.0.1.6", Hostname: "device3.example.com"}, hostPending},
+	}
+	for i, v := range registrations {
+		if registered, _, err := registerHost(cliAudit(), v.host, false); err != nil || registered.Status != v.status {
+			t.Error("Test ", i, ": Expected: ", v.status, "  Actual: ", registered.Status, " ", err)
+		}
+	}
+
+	tokens := make(map[string]string)
+	for _, v := range [][]string{{"writer", "write"}, {"admin", "admin"}} {
+		plaintoken, _, err := createToken(v[0], v[1], "", "")
+		if err != nil {
+			t.Fatal("createToken ", v[0], " failed: ", err)
+		}
+		tokens[v[0]] = plaintoken
+	}
+
+	var tests = []struct {
+		token    string
+		method   string
+		path     string
+		body     string
+		status   int
+		contains string
+		missing  string
+	}{
+		{"writer", "GET", "/hosts", ``, http.StatusOK, "device2.example.com", "device1.example.com"},
+		{"writer", "GET", "/hosts?pending=y", ``, http.StatusOK, "device1.example.com", "device2.example.com"},
+		{"writer", "POST", "/host/device1.example.com/approve", ``, http.StatusForbidden, "", ""},
+		{"writer", "PATCH", "/host/device1.example.com", `{"Status":"active"}`, http.StatusForbidden, "", ""},
+		{"writer", "PATCH", "/host/device1.example.com", `{"MAC":"DEADBEEFCAFE"}`, http.StatusOK, hostPending, ""},
+		{"admin", "POST", "/host/device2.example.com/approve", ``, http.StatusConflict, "", ""},
+		{"admin", "POST", "/host/device1.example.com/approve", ``, http.StatusOK, hostActive, ""},
+		{"admin", "POST", "/host/device3.example.com/reject", ``, http.StatusNoContent, "", ""},
+		{"admin", "POST", "/host/device3.example.com/reject", ``, http.StatusNotFound, "", ""},
+		{"writer", "GET", "/hosts", ``, http.StatusOK, "device1.example.com", "device3.example.com"},
+	}
+	for i, v := range tests {
+		request := httptest.NewRequest(v.method, v.path, strings.NewReader(v.body))
+		request.Header.Set("Authorization", "Bearer "+tokens[v.token])
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		body := recorder.Body.String()
+		if recorder.Code != v.status || !strings.Contains(body, v.contains) || (v.missing != "" && strings.Contains(body, v.missing)) {
+			t.Error("Test ", i, ": Expected: ", v.status, " ", v.contains, "  Actual: ", recorder.Code, " ", body)
+		}
+	}
+
+	// registration cannot change an approved host unless the network auto approves, the approved host stays live
+	var upserts = []struct {
+		host      Host
+		forbidden bool
+		result    string
+		ipv4      string
+	}{
+		{Host{Network: "10.0.1", IPv4: "10.0.1.5", Hostname: "device1.example.com"}, false, registrationUnchanged, "10.0.1.5"},
+		{Host{Network: "10.0.1", IPv4: "10.0.1.7", Hostname: "device1.example.com"}, true, "", "10.0.1.5"},
+		{Host{Network: "10.0.1", IPv4: "10.0.1.7", Hostname: "device1.example.com", MAC: "DEADBEEFCAFE"}, true, "", "10.0.1.5"},
+		{Host{Network: "10.0.2", IPv4: "10.0.2.7", Hostname: "device2.example.com"}, false, registrationUpdated, "10.0.2.7"},
+	}
+	for i, v := range upserts {
+		_, result, err := registerHost(cliAudit(), v.host, true)
+		_, forbidden := err.(ForbiddenError)
+		current, _ := store.GetHost(v.host.Hostname, v.host.Network)
+		if (err != nil && !forbidden) || forbidden != v.forbidden || result != v.result || current.Status != hostActive || current.IPv4 != v.ipv4 {
+			t.Error("Upsert test ", i, ": Expected: ", v.forbidden, " ", v.result, " ", hostActive, " ", v.ipv4, "  Actual: ", err, " ", result, " ", current.Status, " ", current.IPv4)
+		}
+	}
+}
+
+func TestDNSRecords(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.5", Hostname: "server1.example.com", Status: hostActive})
+	records := &dnsRecords{maxage: time.Hour}
+
+	// hosts added after the records were read are not seen until they are older than maxage
+	var tests = []struct {
+		add    Host
+		expire bool
+		hosts  int
+	}{
+		{Host{}, false, 1},
+		{Host{Network: "10.0.1", IPv4: "10.0.1.6", Hostname: "server2.example.com", Status: hostActive}, false, 1},
+		{Host{}, true, 2},
+		{Host{Network: "10.0.1", IPv4: "10.0.1.7", Hostname: "server3.example.com", Status: hostActive}, true, 3},
+	}
+	for i, v := range tests {
+		if v.add.Hostname != "" {
+			store.CreateHost(v.add)
+		}
+		if v.expire {
+			records.loaded = time.Now().Add(-2 * time.Hour)
+		}
+		mynetworks, myhosts, err := records.get()
+		if err != nil || len(mynetworks) != 1 || len(myhosts) != v.hosts {
+			t.Error("Test ", i, ": Expected: ", v.hosts, "  Actual: ", len(myhosts), " ", err)
+		}
+	}
+}
+
+func TestDNSServer(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	store.CreateNetwork(SingleNetwork{Network: "fd00", CIDR: "fd00::/64"})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.5", IPv6: "fd00::5", Hostname: "server1.example.com", Aliases: []string{"www", "ftp.example.com"}})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.6", Hostname: "device1.example.com", Status: hostPending})
+	viper.Set("DNSZone", "example.com")
+	viper.Set("DNSAliases", "cname")
+	defer viper.Set("DNSZone", "")
+	zone, err := dnsZoneFromConfig()
+	if err != nil {
+		t.Fatal("cannot read dns settings: ", err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("cannot listen for dns queries: ", err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dnsHandler(zone)}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	var tests = []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"server1.example.com.", dns.TypeA, dns.RcodeSuccess, "10.0.1.5"},
+		{"SERVER1.example.com.", dns.TypeAAAA, dns.RcodeSuccess, "fd00::5"},
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, "server1.example.com."},
+		{"ftp.example.com.", dns.TypeCNAME, dns.RcodeSuccess, "server1.example.com."},
+		{"5.1.0.10.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, "server1.example.com."},
+		{"5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR, dns.RcodeSuccess, "server1.example.com."},
+		{"9.1.0.10.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, ""},
+		{"1.0.10.in-addr.arpa.", dns.TypeSOA, dns.RcodeSuccess, "hostmaster.example.com."},
+		{"5.1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeRefused, ""},
+		{"example.com.", dns.TypeSOA, dns.RcodeSuccess, "hostmaster.example.com."},
+		{"server1.example.com.", dns.TypeMX, dns.RcodeSuccess, ""},
+		{"device1.example.com.", dns.TypeA, dns.RcodeNameError, ""},
+		{"nothere.example.com.", dns.TypeA, dns.RcodeNameError, ""},
+		{"server1.example.org.", dns.TypeA, dns.RcodeRefused, ""},
+	}
+	for i, v := range tests {
+		query := new(dns.Msg)
+		query.SetQuestion(v.name, v.qtype)
+		reply, err := dns.Exchange(query, conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal("Test ", i, ": dns query failed: ", err)
+		}
+		var answers []string
+		for _, rr := range reply.Answer {
+			answers = append(answers, rr.String())
+		}
+		if reply.Rcode != v.rcode || !strings.Contains(strings.Join(answers, "\n"), v.answer) || (v.answer == "" && len(answers) > 0) {
+			t.Error("Test ", i, ": Expected: ", dns.RcodeToString[v.rcode], " ", v.answer, "  Actual: ", dns.RcodeToString[reply.Rcode], " ", answers)
+		}
+		if reply.Rcode == dns.RcodeNameError && len(reply.Ns) == 0 {
+			t.Error("Test ", i, ": Expected: soa in the authority section  Actual: ", reply.Ns)
+		}
+	}
+}
+
+func TestDNSAliases(t *testing.T) {
+	viper.Set("DNSZone", "example.com")
+	defer viper.Set("DNSZone", "")
+	defer viper.Set("DNSAliases", "cname")
+	myhosts := []Host{
+		{Network: "10.0.1", IPv4: "10.0.1.5", Hostname: "server1.example.com", Aliases: []string{"www"}},
+		{Network: "10.0.1", IPv4: "10.0.1.7", Hostname: "mail.example.com", Aliases: []string{"www", "server1"}},
+	}
+
+	var tests = []struct {
+		name     string
+		mode     string
+		expected string
+	}{
+		{"server1.example.com.", "cname", "A 10.0.1.5"},
+		{"www.example.com.", "cname", "CNAME server1.example.com. A 10.0.1.5"},
+		{"www.example.com.", "a", "A 10.0.1.5 A 10.0.1.7"},
+	}
+	for i, v := range tests {
+		viper.Set("DNSAliases", v.mode)
+		zone, err := dnsZoneFromConfig()
+		if err != nil {
+			t.Fatal("cannot read dns settings: ", err)
+		}
+		m := new(dns.Msg)
+		zone.answer(m, dns.Question{Name: v.name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, nil, myhosts)
+		var answers []string
+		for _, rr := range m.Answer {
+			fields := strings.Fields(rr.String())
+			answers = append(answers, dns.TypeToString[rr.Header().Rrtype]+" "+fields[len(fields)-1])
+		}
+		if strings.Join(answers, " ") != v.expected {
+			t.Error("Test ", i, ": Expected: ", v.expected, "  Actual: ", strings.Join(answers, " "))
+		}
+	}
+}
+
+func TestReverseZonesForCIDR(t *testing.T) {
+	var tests = []string{"192.168.1.0/24", "192.168.1/24", "10.0.0.0/8", "172.16.0.0/22", "192.168.1.128/25", "fd00:1::/64"}
+	var expectedresults = []string{
+		"1.168.192.in-addr.arpa.",
+		"1.168.192.in-addr.arpa.",
+		"10.in-addr.arpa.",
+		"0.16.172.in-addr.arpa. 1.16.172.in-addr.arpa. 2.16.172.in-addr.arpa. 3.16.172.in-addr.arpa.",
+		"1.168.192.in-addr.arpa.",
+		"0.0.0.0.0.0.0.0.1.0.0.0.0.0.d.f.ip6.arpa.",
+	}
+	for i, v := range tests {
+		zones, err := reverseZonesForCIDR(v)
+		if err != nil || strings.Join(zones, " ") != expectedresults[i] {
+			t.Error("Test ", i, ": Expected: ", expectedresults[i], "  Actual: ", zones, " ", err)
+		}
+	}
+}
+
+func TestNextSerial(t *testing.T) {
+	now := time.Date(2019, 1, 31, 12, 0, 0, 0, time.UTC)
+	var tests = []uint32{0, 1548936000, 2019013100, 2019013105, 2019020100, 4000000000}
+	var expectedresults = []uint32{2019013100, 2019013100, 2019013101, 2019013106, 2019020101, 4000000001}
+	for i, v := range tests {
+		if nextSerial(v, now) != expectedresults[i] {
+			t.Error("Test ", i, ": Expected: ", expectedresults[i], "  Actual: ", nextSerial(v, now))
+		}
+	}
+}
+
+func TestExportZones(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.5", IPv6: "fd00::5", Hostname: "server1.example.com", Aliases: []string{"www"}})
+	viper.Set("DNSZone", "example.com")
+	defer viper.Set("DNSZone", "")
+	directory, err := ioutil.TempDir("", "narcotk-zones")
+	if err != nil {
+		t.Fatal("cannot create directory: ", err)
+	}
+	defer os.RemoveAll(directory)
+
+	readZone := func(origin string) string {
+		content, _ := ioutil.ReadFile(directory + "/db." + origin)
+		return string(content)
+	}
+	if err := exportZones(directory); err != nil {
+		t.Fatal("exportZones failed: ", err)
+	}
+	var tests = []struct {
+		origin string
+		record string
+	}{
+		{"example.com", "server1.example.com.\t300\tIN\tA\t10.0.1.5"},
+		{"example.com", "www.example.com.\t300\tIN\tCNAME\tserver1.example.com."},
+		{"example.com", "ns1.example.com. hostmaster.example.com."},
+		{"1.0.10.in-addr.arpa", "5.1.0.10.in-addr.arpa.\t300\tIN\tPTR\tserver1.example.com."},
+		{"0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", "IN\tPTR\tserver1.example.com."},
+	}
+	for i, v := range tests {
+		if !strings.Contains(readZone(v.origin), v.record) {
+			t.Error("Test ", i, ": Expected: ", v.record, "  Actual: ", readZone(v.origin))
+		}
+	}
+
+	serial := zoneFileSerial(readZone("example.com"))
+	exportZones(directory)
+	if zoneFileSerial(readZone("example.com")) != serial {
+		t.Error("Expected: serial to stay at ", serial, " when nothing changed  Actual: ", zoneFileSerial(readZone("example.com")))
+	}
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.6", Hostname: "server2.example.com"})
+	exportZones(directory)
+	if zoneFileSerial(readZone("example.com")) != serial+1 || zoneFileSerial(readZone("1.0.10.in-addr.arpa")) != serial+1 {
+		t.Error("Expected: serials to be bumped to ", serial+1, "  Actual: ", readZone("example.com"))
+	}
+	if zoneFileSerial(readZone("0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa")) != serial {
+		t.Error("Expected: unchanged ip6.arpa zone to keep serial ", serial)
+	}
+}
+
+func TestDnsmasqFormat(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	store.CreateNetwork(SingleNetwork{Network: "10.0.2", CIDR: "10.0.2.0/26"})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.5", IPv6: "fd00::5", Hostname: "server1.example.com", Aliases: []string{"www", "server1"}, MAC: "de:ad:be:ef:ca:fe"})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.6", Hostname: "printer.example.com"})
+	store.CreateHost(Host{Network: "10.0.2", IPv4: "10.0.2.7", Hostname: "device.example.com", MAC: "de:ad:be:ef:ca:01", Status: hostPending})
+	store.CreateHost(Host{Network: "10.0.2", IPv4: "10.0.2.300", Hostname: "legacy.example.com", MAC: "de:ad:be:ef:ca:02"})
+
+	var b bytes.Buffer
+	if err := writeFormat(&b, HostFilter{Status: hostActive}, "dnsmasq"); err != nil {
+		t.Fatal("writeFormat failed: ", err)
+	}
+	var tests = []struct {
+		line     string
+		expected bool
+	}{
+		{"dhcp-range=10.0.1.1,10.0.1.254,255.255.255.0,12h\n", true},
+		{"dhcp-range=10.0.2.1,10.0.2.62,255.255.255.192,12h\n", true},
+		{"dhcp-host=de:ad:be:ef:ca:fe,10.0.1.5,server1\n", true},
+		{"host-record=server1.example.com,www,server1,10.0.1.5,fd00::5\n", true},
+		{"host-record=printer.example.com,10.0.1.6\n", true},
+		{"dhcp-host=,10.0.1.6", false},
+		{"dhcp-host=de:ad:be:ef:ca:02", false},
+		{"host-record=legacy.example.com\n", true},
+		{"device.example.com", false},
+	}
+	for i, v := range tests {
+		if strings.Contains(b.String(), v.line) != v.expected {
+			t.Error("Test ", i, ": Expected: ", v.line, " present ", v.expected, "  Actual: ", b.String())
+		}
+	}
+
+	var tests2 = []struct {
+		network string
+		format  string
+		err     error
+	}{
+		{"10.0.2", "dnsmasq", nil},
+		{"10.0.3", "dnsmasq", ErrNotFound},
+		{"", "unknown", ValidationError{"unknown format unknown, use: csv, dhcpd, dnsmasq, kea"}},
+	}
+	for i, v := range tests2 {
+		if err := writeFormat(ioutil.Discard, HostFilter{Network: v.network, Status: hostActive}, v.format); err != v.err {
+			t.Error("Test ", i, ": Expected: ", v.err, "  Actual: ", err)
+		}
+	}
+
+	var tests3 = []struct {
+		lease    time.Duration
+		expected string
+	}{
+		{12 * time.Hour, "12h"},
+		{90 * time.Minute, "90m"},
+		{150 * time.Second, "150"},
+	}
+	for i, v := range tests3 {
+		if actual := dnsmasqLease(v.lease); actual != v.expected {
+			t.Error("Test ", i, ": Expected: ", v.expected, "  Actual: ", actual)
+		}
+	}
+}
+
+func TestDhcpFormats(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24", Description: "lab"})
+	store.CreateNetwork(SingleNetwork{Network: "v6", CIDR: "fd00::/64"})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.5", Hostname: "server1.example.com", MAC: "DE:AD:BE:EF:CA:FE"})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.6", Hostname: "printer.example.com"})
+
+	var dhcpd bytes.Buffer
+	if err := writeFormat(&dhcpd, HostFilter{Status: hostActive}, "dhcpd"); err != nil {
+		t.Fatal("writeFormat failed: ", err)
+	}
+	var tests = []struct {
+		line     string
+		expected bool
+	}{
+		{"subnet 10.0.1.0 netmask 255.255.255.0 {\n\tdefault-lease-time 43200;\n", true},
+		{"\thost server1.example.com_10.0.1 {\n\t\thardware ethernet de:ad:be:ef:ca:fe;\n\t\tfixed-address 10.0.1.5;\n\t\toption host-name \"server1\";\n\t}\n", true},
+		{"printer", false},
+		{"fd00::", false},
+	}
+	for i, v := range tests {
+		if strings.Contains(dhcpd.String(), v.line) != v.expected {
+			t.Error("Test ", i, ": Expected: ", v.line, " present ", v.expected, "  Actual: ", dhcpd.String())
+		}
+	}
+
+	var kea bytes.Buffer
+	if err := writeFormat(&kea, HostFilter{Status: hostActive}, "kea"); err != nil {
+		t.Fatal("writeFormat failed: ", err)
+	}
+	var config keaConfig
+	if err := json.Unmarshal(kea.Bytes(), &config); err != nil {
+		t.Fatal("cannot parse kea configuration: ", err, kea.String())
+	}
+	expected := keaSubnet{ID: 167772416, Subnet: "10.0.1.0/24", Comment: "10.0.1 lab", Reservations: []keaReservation{{HWAddress: "de:ad:be:ef:ca:fe", IPAddress: "10.0.1.5", Hostname: "server1.example.com"}}}
+	if config.Dhcp4.ValidLifetime != 43200 || len(config.Dhcp4.Subnet4) != 1 || fmt.Sprint(config.Dhcp4.Subnet4[0]) != fmt.Sprint(expected) {
+		t.Error("Expected: ", expected, "  Actual: ", kea.String())
+	}
+}
+
+func TestShowHeader(t *testing.T) {
+	viper.Set("showheader", true)
+	defer viper.Set("showheader", false)
+
+	// the header is only printed before the plain text listings
+	var tests = []struct {
+		json      bool
+		inventory bool
+		format    string
+		expected  bool
+	}{
+		{false, false, "", true},
+		{true, false, "", false},
+		{false, true, "", false},
+		{false, false, "dnsmasq", false},
+		{false, false, "dhcpd", false},
+		{false, false, "kea", false},
+	}
+	for i, v := range tests {
+		viper.Set("json", v.json)
+		viper.Set("ansible-inventory", v.inventory)
+		viper.Set("format", v.format)
+		if showHeader() != v.expected {
+			t.Error("Test ", i, ": Expected: ", v.expected, "  Actual: ", showHeader())
+		}
+	}
+	viper.Set("json", false)
+	viper.Set("ansible-inventory", false)
+	viper.Set("format", "")
+}
+
+func TestAnsibleInventory(t *testing.T) {
+	var tests = []struct {
+		network  SingleNetwork
+		expected string
+	}{
+		{SingleNetwork{Network: "192.168.1", Description: "Home Network"}, "Home_Network"},
+		{SingleNetwork{Network: "192.168.1", Description: "lab-1"}, "lab_1"},
+		{SingleNetwork{Network: "192.168.1"}, "network_192_168_1"},
+		{SingleNetwork{Network: "dmz", Description: "2nd floor"}, "network_2nd_floor"},
+	}
+	for i, v := range tests {
+		if actual := ansibleGroupName(v.network); actual != v.expected {
+			t.Error("Test ", i, ": Expected: ", v.expected, "  Actual: ", actual)
+		}
+	}
+
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24", Description: "lab"})
+	store.CreateNetwork(SingleNetwork{Network: "10.0.2", CIDR: "10.0.2.0/24"})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.5", IPv6: "fd00::5", Hostname: "server1.example.com", Aliases: []string{"www"}, MAC: "de:ad:be:ef:ca:fe"})
+	store.CreateHost(Host{Network: "10.0.2", IPv4: "10.0.2.5", Hostname: "server2.example.com"})
+	store.CreateHost(Host{Network: "10.0.2", IPv4: "10.0.2.6", Hostname: "device.example.com", Status: hostPending})
+
+	viper.Set("RequireToken", false)
+	defer viper.Set("RequireToken", true)
+	router := newRouter()
+	var inventory struct {
+		Meta struct {
+			Hostvars map[string]ansibleHostVars `json:"hostvars"`
+		} `json:"_meta"`
+		All ansibleGroup `json:"all"`
+		Lab ansibleGroup `json:"lab"`
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/inventory/ansible", nil))
+	if err := json.Unmarshal(recorder.Body.Bytes(), &inventory); err != nil {
+		t.Fatal("cannot parse inventory: ", err, recorder.Body.String())
+	}
+	expected := ansibleHostVars{AnsibleHost: "10.0.1.5", IPv4: "10.0.1.5", IPv6: "fd00::5", MAC: "de:ad:be:ef:ca:fe", Aliases: []string{"www"}, Network: "10.0.1"}
+	if fmt.Sprint(inventory.Meta.Hostvars["server1.example.com"]) != fmt.Sprint(expected) {
+		t.Error("Expected: ", expected, "  Actual: ", inventory.Meta.Hostvars["server1.example.com"])
+	}
+	if fmt.Sprint(inventory.All.Children) != "[lab network_10_0_2]" || fmt.Sprint(inventory.Lab.Hosts) != "[server1.example.com]" || inventory.Lab.Vars["cidr"] != "10.0.1.0/24" {
+		t.Error("Expected: groups lab and network_10_0_2  Actual: ", recorder.Body.String())
+	}
+	if _, ok := inventory.Meta.Hostvars["device.example.com"]; ok {
+		t.Error("Expected: pending host to be left out  Actual: ", recorder.Body.String())
+	}
+
+	var tests2 = []struct {
+		path     string
+		expected string
+	}{
+		{"/inventory/ansible?host=server2.example.com", `{"aliases":[],"ansible_host":"10.0.2.5","ipv4":"10.0.2.5","ipv6":"","mac":"","network":"10.0.2"}`},
+		{"/inventory/ansible?host=device.example.com", `{}`},
+	}
+	for i, v := range tests2 {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", v.path, nil))
+		if recorder.Code != http.StatusOK || strings.TrimSpace(recorder.Body.String()) != v.expected {
+			t.Error("Test ", i, ": Expected: ", v.expected, "  Actual: ", recorder.Code, " ", recorder.Body.String())
+		}
+	}
+}
+
+func TestReplaceManagedBlock(t *testing.T) {
+	block := hostsBlockBegin + "\n10.0.1.5    server1\n" + hostsBlockEnd + "\n"
+	var tests = []struct {
+		existing string
+		expected string
+		err      bool
+	}{
+		{"", block, false},
+		{"127.0.0.1 localhost", "127.0.0.1 localhost\n" + block, false},
+		{"127.0.0.1 localhost\n" + hostsBlockBegin + "\nold\n" + hostsBlockEnd + "\n::1 localhost\n", "127.0.0.1 localhost\n" + block + "::1 localhost\n", false},
+		{hostsBlockBegin + "\n" + hostsBlockEnd, block, false},
+		{"127.0.0.1 localhost\n" + hostsBlockBegin + "\nold\n", "", true},
+		{hostsBlockEnd + "\n" + hostsBlockBegin + "\n", "", true},
+		{hostsBlockBegin + "\n" + hostsBlockEnd + "\n" + hostsBlockBegin + "\n" + hostsBlockEnd + "\n", "", true},
+	}
+	for i, v := range tests {
+		actual, err := replaceManagedBlock(v.existing, block)
+		if actual != v.expected || (err != nil) != v.err {
+			t.Error("Test ", i, ": Expected: ", v.expected, v.err, "  Actual: ", actual, err)
+		}
+	}
+}
+
+func TestSyncHostsFile(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.5", IPv6: "fd00::5", Hostname: "server1.example.com", Aliases: []string{"server1"}})
+	directory, err := ioutil.TempDir("", "narcotk-hostsfile")
+	if err != nil {
+		t.Fatal("cannot create directory: ", err)
+	}
+	defer os.RemoveAll(directory)
+	filename := directory + "/hosts"
+	ioutil.WriteFile(filename, []byte("127.0.0.1 localhost\n"), 0600)
+
+	written, count, err := syncHostsFile(filename, "")
+	content, _ := ioutil.ReadFile(filename)
+	expected := "127.0.0.1 localhost\n" + hostsBlockBegin + "\n# managed by narcotk-hosts, changes within this block will be overwritten\n" +
+		"10.0.1.5           server1.example.com  server1\nfd00::5            server1.example.com  server1\n" + hostsBlockEnd + "\n"
+	if !written || count != 1 || err != nil || string(content) != expected {
+		t.Error("Expected: ", expected, "  Actual: ", written, count, err, string(content))
+	}
+	if info, _ := os.Stat(filename); info.Mode().Perm() != 0600 {
+		t.Error("Expected: permissions 0600 to be kept  Actual: ", info.Mode().Perm())
+	}
+	if written, _, err := syncHostsFile(filename, ""); written || err != nil {
+		t.Error("Expected: unchanged hosts file not to be written  Actual: ", written, err)
+	}
+}
+
+func TestImportHostsFile(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.5", Hostname: "server1.example.com", Aliases: []string{"server1"}, Status: hostActive})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.6", Hostname: "server2.example.com", Status: hostActive})
+	hostsfile := `127.0.0.1          localhost localhost.localdomain localhost4 localhost4.localdomain4
+::1                localhost localhost.localdomain localhost6 localhost6.localdomain6
+# servers
+10.0.1.5    server1.example.com server1 www   # gains an alias
+10.0.1.6    server2.example.com
+10.0.1.7    server3.example.com server3
+fd00::7     server3.example.com
+10.0.1.7    server4.example.com
+10.0.2.8    server5.example.com
+10.0.1.6    server6.example.com
+not-an-ip   server7.example.com
+fd00::8     server8.example.com
+fd00::9     server1.example.com
+`
+	entries, err := parseHostsFile(strings.NewReader(hostsfile), "10.0.1")
+	if err != nil {
+		t.Fatal("parseHostsFile failed: ", err)
+	}
+	if err := planHostsImport(entries); err != nil {
+		t.Fatal("planHostsImport failed: ", err)
+	}
+	var tests = []struct {
+		line   int
+		action string
+		fqdn   string
+	}{
+		{1, importSkip, "localhost"},
+		{2, importSkip, "localhost"},
+		{4, importUpdate, "server1.example.com"},
+		{5, importUnchanged, "server2.example.com"},
+		{6, importCreate, "server3.example.com"},
+		{8, importConflict, "server4.example.com"},
+		{9, importConflict, "server5.example.com"},
+		{10, importConflict, "server6.example.com"},
+		{11, importSkip, "server7.example.com"},
+		{12, importSkip, "server8.example.com"},
+	}
+	if len(entries) != len(tests) {
+		t.Fatal("Expected: ", len(tests), " entries  Actual: ", entries)
+	}
+	for i, v := range tests {
+		if entries[i].Line != v.line || entries[i].Action != v.action || entries[i].Host.Hostname != v.fqdn {
+			t.Error("Test ", i, ": Expected: ", v, "  Actual: ", entries[i])
+		}
+	}
+	if entries[4].Host.IPv6 != "fd00::7" {
+		t.Error("Expected: ipv6 line to be merged in to server3  Actual: ", entries[4].Host)
+	}
+	if entries[2].Host.IPv6 != "fd00::9" {
+		t.Error("Expected: ipv6 line to update server1  Actual: ", entries[2].Host)
+	}
+
+	directory, err := ioutil.TempDir("", "narcotk-import")
+	if err != nil {
+		t.Fatal("cannot create directory: ", err)
+	}
+	defer os.RemoveAll(directory)
+	ioutil.WriteFile(directory+"/hosts", []byte(hostsfile), 0644)
+	if err := importHostsFile(directory+"/hosts", "10.0.1", false); exitCode(err) != exitConflict {
+		t.Error("Expected: dry run to report conflicts  Actual: ", err)
+	}
+	if _, err := store.GetHost("server3.example.com", "10.0.1"); err != ErrNotFound {
+		t.Error("Expected: dry run not to create hosts  Actual: ", err)
+	}
+	importHostsFile(directory+"/hosts", "10.0.1", true)
+	server1, _ := store.GetHost("server1.example.com", "10.0.1")
+	server3, err := store.GetHost("server3.example.com", "10.0.1")
+	if strings.Join(server1.Aliases, " ") != "server1 www" || err != nil || server3.IPv6 != "fd00::7" || server3.Status != hostActive {
+		t.Error("Expected: server1 updated and server3 created  Actual: ", server1, server3, err)
+	}
+	if history, _ := store.ListAuditEntries(AuditFilter{FQDN: "server3.example.com"}); len(history) != 1 || history[0].Action != auditAddHost {
+		t.Error("Expected: import of server3 in the audit log  Actual: ", history)
+	}
+	if _, err := store.GetHost("server4.example.com", "10.0.1"); err != ErrNotFound {
+		t.Error("Expected: conflicting host not to be imported  Actual: ", err)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24", Description: "lab"})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.5", Hostname: "server1.example.com", Aliases: []string{"server1", "www"}, MAC: "de:ad:be:ef:ca:fe", Status: hostActive})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.9", Hostname: "device.example.com", Status: hostPending})
+
+	var hosts, networks bytes.Buffer
+	exportCSV(&hosts, "hosts", "")
+	exportCSV(&networks, "networks", "")
+	var tests = []struct {
+		actual   string
+		expected string
+	}{
+		{hosts.String(), "Network,IPv4,IPv6,Hostname,Aliases,MAC,AllowDuplicate,Status\n10.0.1,10.0.1.5,,server1.example.com,server1 www,de:ad:be:ef:ca:fe,false,active\n10.0.1,10.0.1.9,,device.example.com,,,false,pending\n"},
+		{networks.String(), "Network,CIDR,Description,AutoApprove\n10.0.1,10.0.1.0/24,lab,false\n"},
+	}
+	for i, v := range tests {
+		if v.actual != v.expected {
+			t.Error("Test ", i, ": Expected: ", v.expected, "  Actual: ", v.actual)
+		}
+	}
+
+	viper.Set("RequireToken", false)
+	defer viper.Set("RequireToken", true)
+	router := newRouter()
+	var webtests = []struct {
+		path     string
+		expected string
+	}{
+		{"/hosts?format=csv", "Network,IPv4,IPv6,Hostname,Aliases,MAC,AllowDuplicate,Status\n10.0.1,10.0.1.5,,server1.example.com,server1 www,de:ad:be:ef:ca:fe,false,active\n"},
+		{"/networks?format=csv", networks.String()},
+	}
+	for i, v := range webtests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", v.path, nil))
+		if recorder.Body.String() != v.expected || recorder.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+			t.Error("Test ", i, ": Expected: ", v.expected, "  Actual: ", recorder.Header().Get("Content-Type"), " ", recorder.Body.String())
+		}
+	}
+
+	directory, err := ioutil.TempDir("", "narcotk-csv")
+	if err != nil {
+		t.Fatal("cannot create directory: ", err)
+	}
+	defer os.RemoveAll(directory)
+	badrows := "Network,IPv4,Hostname,MAC\n10.0.1,10.0.1.300,bad.example.com,\n10.0.1,10.0.1.7,badmac.example.com,zz:zz\n10.0.9,10.0.9.1,nonet.example.com,\n10.0.1,10.0.1.8,good.example.com,\n10.0.1,10.0.1.8,dup.example.com,\n"
+	var tests2 = []struct {
+		content string
+		err     string
+	}{
+		{"Network,CIDR,Description\n10.0.2,10.0.2.0/24,office\n10.0.1,10.0.1.0/24,lab updated\n", ""},
+		{"network,ipv4,hostname,aliases,mac\n10.0.1,10.0.1.6,server2.example.com,\"server2,files\",\n\n10.0.2,10.0.2.5,server3.example.com,,\n", ""},
+		{badrows, "4 of 5 rows have problems, nothing was imported"},
+		{"Network,IPv4,Hostname,Colour\n", "line 1: unknown column Colour"},
+		{"Network,Hostname\n", "line 1: column IPv4 is required"},
+	}
+	for i, v := range tests2 {
+		ioutil.WriteFile(directory+"/import.csv", []byte(v.content), 0644)
+		err := importCSV(directory + "/import.csv")
+		if (v.err == "" && err != nil) || (v.err != "" && (err == nil || !strings.Contains(err.Error(), v.err))) {
+			t.Error("Test ", i, ": Expected: ", v.err, "  Actual: ", err)
+		}
+	}
+
+	_, rows, _ := readCSV(strings.NewReader(badrows))
+	_, problems, _ := planHostsCSV(rows)
+	expected := []string{"line 2: ipv4 address is not valid: 10.0.1.300", "line 3: mac address is not valid: zz:zz", "line 4: network does not exist: 10.0.9", "line 6: 10.0.1.8 is already used on line 5"}
+	if strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Error("Expected: ", expected, "  Actual: ", problems)
+	}
+
+	if network, _ := store.GetNetwork("10.0.1"); network.Description != "lab updated" {
+		t.Error("Expected: network 10.0.1 to be updated  Actual: ", network)
+	}
+	if server2, err := store.GetHost("server2.example.com", "10.0.1"); err != nil || strings.Join(server2.Aliases, " ") != "server2 files" || server2.Status != hostActive {
+		t.Error("Expected: server2 to be imported  Actual: ", server2, err)
+	}
+	if _, err := store.GetHost("good.example.com", "10.0.1"); err != ErrNotFound {
+		t.Error("Expected: nothing imported from a file with problems  Actual: ", err)
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	store = newTestStore(t)
+	store.CreateNetwork(SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24", Description: "lab", AutoApprove: true})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.5", IPv6: "::5", Hostname: "server1.example.com", Aliases: []string{"server1", "www"}, MAC: "DE:AD:BE:EF:CA:FE", Status: hostActive})
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.9", Hostname: "device.example.com", Status: hostPending})
+	store.CreateToken(APIToken{Name: "ci", Hash: "abc123", Scopes: []string{"read"}, Created: "2019-01-01T00:00:00Z"})
+	store.CreateRegistrationKey(RegistrationKey{Name: "lab", Key: "secret", Networks: []string{"10.0.1"}, MaxUses: 5, Uses: 2, Created: "2019-01-01T00:00:00Z"})
+	store.CreateAuditEntry(AuditEntry{Time: "2019-01-01T00:00:00Z", Actor: "cli:admin", Action: auditAddHost, Network: "10.0.1", Hostname: "server1.example.com", After: json.RawMessage(`{"Hostname":"server1.example.com"}`)})
+
+	directory, err := ioutil.TempDir("", "narcotk-dump")
+	if err != nil {
+		t.Fatal("cannot create directory: ", err)
+	}
+	defer os.RemoveAll(directory)
+	if err := dumpDatabase(directory+"/dump.json", true); err != nil {
+		t.Fatal("cannot dump database: ", err)
+	}
+	if err := dumpDatabase(directory+"/dump.yaml", false); err != nil {
+		t.Fatal("cannot dump database: ", err)
+	}
+	jsondump, _ := ioutil.ReadFile(directory + "/dump.json")
+	yamldump, _ := ioutil.ReadFile(directory + "/dump.yaml")
+	var tests = []struct {
+		actual   bool
+		expected bool
+	}{
+		{strings.Contains(string(jsondump), "\"Hash\": \"abc123\""), true},
+		{strings.Contains(string(jsondump), "\"Key\": \"secret\""), true},
+		{strings.HasPrefix(string(yamldump), "Version: 2\n"), true},
+		{strings.Contains(string(yamldump), "Actor: cli:admin"), true},
+		{strings.Contains(string(yamldump), "abc123") || strings.Contains(string(yamldump), "secret"), false},
+	}
+	for i, v := range tests {
+		if v.actual != v.expected {
+			t.Error("Test ", i, ": Expected: ", v.expected, "  Actual: ", v.actual)
+		}
+	}
+
+	// merge keeps hosts that are not in the dump and puts back those that changed
+	store.CreateHost(Host{Network: "10.0.1", IPv4: "10.0.1.20", Hostname: "extra.example.com", Status: hostActive})
+	store.UpdateHost("server1.example.com", "10.0.1", Host{Network: "10.0.1", IPv4: "10.0.1.6", Hostname: "server1.example.com", Status: hostActive})
+	if err := restoreDatabase(directory+"/dump.yaml", "merge"); err != nil {
+		t.Fatal("cannot restore dump: ", err)
+	}
+	myhosts, _ := store.ListHosts(HostFilter{})
+	if len(myhosts) != 3 {
+		t.Error("Expected: 3 hosts after a merge  Actual: ", myhosts)
+	}
+	if server1, _ := store.GetHost("server1.example.com", "10.0.1"); server1.IPv4 != "10.0.1.5" || server1.MAC != "DE:AD:BE:EF:CA:FE" || strings.Join(server1.Aliases, " ") != "server1 www" {
+		t.Error("Expected: server1 to be restored  Actual: ", server1)
+	}
+	// the entry already in the audit log is not added again, the restore itself is added
+	if entries, _ := store.ListAuditEntries(AuditFilter{}); len(entries) != 2 || entries[0].Action != auditRestore || entries[1].Actor != "cli:admin" {
+		t.Error("Expected: the dumped audit log entry and a restore entry after a merge  Actual: ", entries)
+	}
+
+	// replace removes everything first, restoring the secrets from a dump that has them
+	store.DeleteToken("ci")
+	if err := restoreDatabase(directory+"/dump.json", "replace"); err != nil {
+		t.Fatal("cannot restore dump: ", err)
+	}
+	myhosts, _ = store.ListHosts(HostFilter{})
+	if len(myhosts) != 2 {
+		t.Error("Expected: 2 hosts after a replace  Actual: ", myhosts)
+	}
+	if device, _ := store.GetHost("device.example.com", "10.0.1"); device.Status != hostPending {
+		t.Error("Expected: device to still be pending  Actual: ", device)
+	}
+	if token, err := store.GetTokenByHash("abc123"); err != nil || token.Name != "ci" {
+		t.Error("Expected: token ci to be restored  Actual: ", token, err)
+	}
+	if key, err := store.GetRegistrationKey("lab"); err != nil || key.Key != "secret" || key.Uses != 2 {
+		t.Error("Expected: registration key lab to be restored  Actual: ", key, err)
+	}
+	// replace puts back the audit log as it was dumped, losing the entry of the merge
+	if entries, _ := store.ListAuditEntries(AuditFilter{}); len(entries) != 2 || entries[0].Action != auditRestore || string(entries[1].After) != `{"Hostname":"server1.example.com"}` {
+		t.Error("Expected: the dumped audit log entry and a restore entry after a replace  Actual: ", entries)
+	}
+
+	var errortests = []struct {
+		content string
+		mode    string
+		err     string
+	}{
+		{"{\"Version\": 3}", "merge", "dump version 3 is newer"},
+		{"Networks: []\n", "merge", "it has no Version"},
+		{"{\"Version\": 1}", "append", "--restoremode must be replace or merge"},
+		{"{\"Version\": 1, \"Hosts\": [{\"Hostname\": \"new.example.com\", \"Network\": \"10.0.9\"}]}", "merge", "nothing was restored"},
+		{"{\"Version\": 2, \"AuditLog\": [{\"Action\": \"addhost\", \"After\": \"{}\"}, {\"Action\": \"delhost\", \"Before\": \"{not json\"}]}", "replace", "audit log entry 2 has a Before or After that is not valid json"},
+	}
+	for i, v := range errortests {
+		ioutil.WriteFile(directory+"/bad.json", []byte(v.content), 0644)
+		err := restoreDatabase(directory+"/bad.json", v.mode)
+		if err == nil || !strings.Contains(err.Error(), v.err) {
+			t.Error("Test ", i, ": Expected: ", v.err, "  Actual: ", err)
+		}
+	}
+
+	ioutil.WriteFile(directory+"/nostatus.yaml", []byte("Version: 1\nHosts:\n- Hostname: new.example.com\n  Network: 10.0.1\n  IPv4: 10.0.1.30\n"), 0644)
+	if err := restoreDatabase(directory+"/nostatus.yaml", "merge"); err != nil {
+		t.Fatal("cannot restore dump: ", err)
+	}
+	if host, err := store.GetHost("new.example.com", "10.0.1"); err != nil || host.Status != hostActive {
+		t.Error("Expected: a host without a status to be restored as active  Actual: ", host, err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	store = newTestStore(t)
+	viper.Set("RequireToken", true)
+	defer viper.Set("RequireToken", true)
+	router := newRouter()
+	admin, _, _ := createToken("admin", "admin,write", "", "")
+	writer, _, _ := createToken("writer", "write", "", "")
+
+	cli := auditContext{Actor: "cli:tester"}
+	addNetwork(cli, SingleNetwork{Network: "10.0.1", CIDR: "10.0.1.0/24"})
+	addHost(cli, Host{Network: "10.0.1", IPv4: "10.0.1.5", Hostname: "server1.example.com", MAC: "de:ad:be:ef:ca:fe"})
+	updateHost(cli, "server1.example.com", "10.0.1", Host{Network: "10.0.1", IPv4: "10.0.1.6", Hostname: "server1.example.com", Aliases: []string{"server1"}, MAC: "de:ad:be:ef:ca:ff"})
+	registerHost(auditContext{Actor: "regkey:lab", SourceIP: "10.0.1.7"}, Host{Network: "10.0.1", IPv4: "10.0.1.7", Hostname: "device.example.com"}, false)
+	approveHost(cli, "device.example.com", "10.0.1")
+
+	request := httptest.NewRequest("DELETE", "/host/server1.example.com?network=10.0.1", nil)
+	request.Header.Set("Authorization", "Bearer "+writer)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatal("Expected: ", http.StatusNoContent, "  Actual: ", recorder.Code, " ", recorder.Body.String())
+	}
+	if err := delHost(cli, "nothere.example.com", "10.0.1"); err != ErrNotFound {
+		t.Error("Expected: ", ErrNotFound, "  Actual: ", err)
+	}
+
+	entries, _ := store.ListAuditEntries(AuditFilter{})
+	var actual []string
+	for _, entry := range entries {
+		actual = append(actual, entry.Action+" "+entry.Actor+" "+entry.SourceIP+" "+entry.Hostname+" "+entry.Network)
+	}
+	expected := []string{
+		"delhost token:writer 192.0.2.1 server1.example.com 10.0.1",
+		"approve cli:tester  device.example.com 10.0.1",
+		"register regkey:lab 10.0.1.7 device.example.com 10.0.1",
+		"updatehost cli:tester  server1.example.com 10.0.1",
+		"addhost cli:tester  server1.example.com 10.0.1",
+		"addnetwork cli:tester   10.0.1",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Error("Expected: ", expected, "  Actual: ", actual)
+	}
+	var tests = []struct {
+		actual   string
+		expected string
+	}{
+		{auditChanges(entries[3]), "Aliases  -> server1, IPv4 10.0.1.5 -> 10.0.1.6, MAC de:ad:be:ef:ca:fe -> de:ad:be:ef:ca:ff"},
+		{auditChanges(entries[1]), "Status pending -> active"},
+		{string(entries[0].After), ""},
+		{string(entries[5].Before), ""},
+	}
+	for i, v := range tests {
+		if v.actual != v.expected {
+			t.Error("Test ", i, ": Expected: ", v.expected, "  Actual: ", v.actual)
+		}
+	}
+
+	var webtests = []struct {
+		token   string
+		path    string
+		status  int
+		entries int
+	}{
+		{admin, "/history", http.StatusOK, 6},
+		{admin, "/history?host=server1.example.com", http.StatusOK, 3},
+		{writer, "/history", http.StatusForbidden, 0},
+	}
+	for i, v := range webtests {
+		request := httptest.NewRequest("GET", v.path, nil)
+		request.Header.Set("Authorization", "Bearer "+v.token)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		var history []AuditEntry
+		json.Unmarshal(recorder.Body.Bytes(), &history)
+		if recorder.Code != v.status || len(history) != v.entries {
+			t.Error("Test ", i, ": Expected: ", v.status, " ", v.entries, "  Actual: ", recorder.Code, " ", len(history))
+		}
+	}
+
+	// hosts moved by renaming their network get an entry each
+	if _, err := updateNetwork(cli, "10.0.1", SingleNetwork{Network: "lab", CIDR: "10.0.1.0/24"}); err != nil {
+		t.Fatal("cannot rename network: ", err)
+	}
+	entries, _ = store.ListAuditEntries(AuditFilter{FQDN: "device.example.com"})
+	if len(entries) != 3 || entries[0].Action != auditUpdateHost || entries[0].Network != "lab" || auditChanges(entries[0]) != "Network 10.0.1 -> lab" {
+		t.Error("Expected: an updatehost entry moving device.example.com to lab  Actual: ", entries)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// migration upgrades the database schema by one version
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx, databaseType string) error
+}
+
+// migrations are applied in order by --migrate, new schema changes must be appended to the end.
+// Version 0 is the legacy hostid/ipsuffix/ipaddress schema found in sqlite-schema.txt
+var migrations = []migration{
+	{1, "convert legacy hostid/ipsuffix/ipaddress hosts table to ipv4/ipv6", migrateLegacyHosts},
+	{2, "move short1..short4 in to an aliases table", migrateAliases},
+	{3, "add allowduplicate and unique indexes on ipv4, ipv6 and mac", migrateUniqueAddresses},
+	{4, "add api_tokens table", migrateAPITokens},
+	{5, "add registration_keys table", migrateRegistrationKeys},
+	{6, "add host status and network autoapprove", migrateApproval},
+	{7, "add audit_log table", migrateAuditLog},
+}
+
+// latestSchemaVersion returns the schema version this build of narcotk-hosts expects
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// schemaVersionStatement returns the statement used to create the schema_version table
+func schemaVersionStatement(databaseType string) string {
+	if databaseType == "mysql" {
+		return "CREATE TABLE schema_version (version integer NOT NULL, applied varchar(64) NOT NULL, description varchar(255) NOT NULL)"
+	}
+	return "CREATE TABLE schema_version (version integer NOT NULL, applied text NOT NULL, description text NOT NULL)"
+}
+
+// recordSchemaVersion notes in schema_version that a migration has been applied
+func recordSchemaVersion(execer interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, databaseType string, version int, description string) error {
+	_, err := execer.Exec(rebind(databaseType, "insert into schema_version (version, applied, description) values (?, ?, ?)"), version, time.Now().UTC().Format(time.RFC3339), description)
+	return err
+}
+
+// currentSchemaVersion works out the schema version of a database, databases created before
+// schema_version existed are detected by the columns of their hosts table
+func currentSchemaVersion(db *sql.DB) (int, bool, error) {
+	var version sql.NullInt64
+	if err := db.QueryRow("select max(version) from schema_version").Scan(&version); err == nil {
+		if version.Valid {
+			return int(version.Int64), true, nil
+		}
+		return 0, true, nil
+	}
+	if rows, err := db.Query("select hostid from hosts where 1 = 0"); err == nil {
+		rows.Close()
+		return 0, false, nil
+	}
+	if rows, err := db.Query("select ipv4 from hosts where 1 = 0"); err == nil {
+		rows.Close()
+		return 1, false, nil
+	}
+	return 0, false, errors.New("cannot find a hosts table, use --setupdb to create a new database")
+}
+
+// checkSchemaVersion makes sure the database schema matches what this build of narcotk-hosts expects
+func checkSchemaVersion(db *sql.DB) error {
+	version, _, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > latestSchemaVersion() {
+		return errors.New("database schema version " + strconv.Itoa(version) + " is newer than this narcotk-hosts supports (" + strconv.Itoa(latestSchemaVersion()) + "), upgrade narcotk-hosts")
+	}
+	if version < latestSchemaVersion() {
+		return errors.New("database schema version " + strconv.Itoa(version) + " is older than this narcotk-hosts expects (" + strconv.Itoa(latestSchemaVersion()) + "), run --migrate")
+	}
+	return nil
+}
+
+// migrateDatabase applies every migration newer than the current database schema version
+func migrateDatabase(db *sql.DB, databaseType string) error {
+	version, versioned, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > latestSchemaVersion() {
+		return errors.New("database schema version " + strconv.Itoa(version) + " is newer than this narcotk-hosts supports (" + strconv.Itoa(latestSchemaVersion()) + ")")
+	}
+
+	if !versioned {
+		if _, err := db.Exec(schemaVersionStatement(databaseType)); err != nil {
+			return err
+		}
+		if version > 0 {
+			if err := recordSchemaVersion(db, databaseType, version, "existing database"); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		log.Printf("applying migration %d: %s", m.version, m.description)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.apply(tx, databaseType); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %s", m.version, err)
+		}
+		if err := recordSchemaVersion(tx, databaseType, m.version, m.description); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	log.Printf("database schema is at version %d", latestSchemaVersion())
+	return nil
+}
+
+// mysql commits each schema change straight away rather than with the transaction of the migration, so a
+// migration that fails part way leaves its earlier schema changes behind. Each schema change is skipped on
+// mysql when it has already been made, so --migrate can be run again to finish the migration
+
+// mysqlHas reports whether a count of information_schema rows is more than zero
+func mysqlHas(tx *sql.Tx, sqlquery string, args ...interface{}) (bool, error) {
+	var count int
+	err := tx.QueryRow(sqlquery, args...).Scan(&count)
+	return count > 0, err
+}
+
+// mysqlHasTable reports whether a mysql table exists
+func mysqlHasTable(tx *sql.Tx, table string) (bool, error) {
+	return mysqlHas(tx, "select count(*) from information_schema.tables where table_schema = database() and table_name = ?", table)
+}
+
+// createTable creates a table, unless it already exists on mysql
+func createTable(tx *sql.Tx, databaseType string, table string, sqlquery string) error {
+	if databaseType == "mysql" {
+		if exists, err := mysqlHasTable(tx, table); err != nil || exists {
+			return err
+		}
+	}
+	_, err := tx.Exec(sqlquery)
+	return err
+}
+
+// addColumn adds a column to a table, unless it already exists on mysql
+func addColumn(tx *sql.Tx, databaseType string, table string, column string, sqlquery string) error {
+	if databaseType == "mysql" {
+		if exists, err := mysqlHas(tx, "select count(*) from information_schema.columns where table_schema = database() and table_name = ? and column_name = ?", table, column); err != nil || exists {
+			return err
+		}
+	}
+	_, err := tx.Exec(sqlquery)
+	return err
+}
+
+// createIndex creates an index on a table, unless it already exists on mysql
+func createIndex(tx *sql.Tx, databaseType string, table string, index string, sqlquery string) error {
+	if databaseType == "mysql" {
+		if exists, err := mysqlHas(tx, "select count(*) from information_schema.statistics where table_schema = database() and table_name = ? and index_name = ?", table, index); err != nil || exists {
+			return err
+		}
+	}
+	_, err := tx.Exec(sqlquery)
+	return err
+}
+
+// migrateLegacyHosts converts the hostid/ipsuffix/ipaddress hosts table in to the ipv4/ipv6 layout
+func migrateLegacyHosts(tx *sql.Tx, databaseType string) error {
+	type legacyHost struct {
+		network, ipsuffix, ipaddress, fqdn, short1, short2, short3, short4, mac sql.NullString
+	}
+
+	if databaseType == "mysql" {
+		hashosts, err := mysqlHasTable(tx, "hosts")
+		if err != nil {
+			return err
+		}
+		hasnew, err := mysqlHasTable(tx, "hosts_new")
+		if err != nil {
+			return err
+		}
+		// a failed run either stopped before the legacy table was dropped, and is started again, or after it
+		// was dropped, leaving only the rename to do
+		if !hashosts && hasnew {
+			_, err = tx.Exec("ALTER TABLE hosts_new RENAME TO hosts")
+			return err
+		}
+		if hasnew {
+			if _, err := tx.Exec("DROP TABLE hosts_new"); err != nil {
+				return err
+			}
+		}
+	}
+
+	rows, err := tx.Query("select network, ipsuffix, ipaddress, fqdn, short1, short2, short3, short4, mac from hosts")
+	if err != nil {
+		return err
+	}
+	var legacyhosts []legacyHost
+	for rows.Next() {
+		var h legacyHost
+		if err := rows.Scan(&h.network, &h.ipsuffix, &h.ipaddress, &h.fqdn, &h.short1, &h.short2, &h.short3, &h.short4, &h.mac); err != nil {
+			rows.Close()
+			return err
+		}
+		legacyhosts = append(legacyhosts, h)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec(hostsTableStatement(databaseType, "hosts_new")); err != nil {
+		return err
+	}
+	for _, h := range legacyhosts {
+		ipv4 := h.ipaddress.String
+		if ipv4 == "" {
+			// some legacy rows only recorded the last octet
+			ipv4 = h.network.String + "." + h.ipsuffix.String
+		}
+		_, err := tx.Exec(rebind(databaseType, "insert into hosts_new (network, ipv4, ipv6, fqdn, short1, short2, short3, short4, mac) values (?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+			h.network.String, ipv4, "", h.fqdn.String, h.short1.String, h.short2.String, h.short3.String, h.short4.String, PrepareMac(h.mac.String))
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DROP TABLE hosts"); err != nil {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE hosts_new RENAME TO hosts")
+	return err
+}
+
+// migrateAliases creates the aliases table and copies in the aliases held in short1..short4
+func migrateAliases(tx *sql.Tx, databaseType string) error {
+	sqlquery := "CREATE TABLE aliases (network text NOT NULL, fqdn text NOT NULL, alias text NOT NULL, aliasorder integer NOT NULL DEFAULT 0)"
+	if databaseType == "mysql" {
+		sqlquery = "CREATE TABLE aliases (network varchar(255) NOT NULL, fqdn varchar(255) NOT NULL, alias varchar(255) NOT NULL, aliasorder integer NOT NULL DEFAULT 0)"
+	}
+	// inserts are rolled back with the transaction, so a table left by a failed run is empty
+	if err := createTable(tx, databaseType, "aliases", sqlquery); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("select network, fqdn, short1, short2, short3, short4 from hosts")
+	if err != nil {
+		return err
+	}
+	var hosts []Host
+	for rows.Next() {
+		var host Host
+		var short1, short2, short3, short4 sql.NullString
+		if err := rows.Scan(&host.Network, &host.Hostname, &short1, &short2, &short3, &short4); err != nil {
+			rows.Close()
+			return err
+		}
+		host.Aliases = mergeAliases(nil, short1.String, short2.String, short3.String, short4.String)
+		hosts = append(hosts, host)
+	}
+	rows.Close()
+
+	for _, host := range hosts {
+		for i, alias := range host.Aliases {
+			if _, err := tx.Exec(rebind(databaseType, "insert into aliases (network, fqdn, alias, aliasorder) values (?, ?, ?, ?)"), host.Network, host.Hostname, alias, i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateUniqueAddresses adds the allowduplicate column and unique indexes on ipv4, ipv6 and mac.
+// Hosts already sharing an address are marked allowduplicate so the indexes can be built, new hosts
+// still need --allow-duplicate to share their addresses
+func migrateUniqueAddresses(tx *sql.Tx, databaseType string) error {
+	if err := addColumn(tx, databaseType, "hosts", "allowduplicate", "ALTER TABLE hosts ADD COLUMN allowduplicate integer NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	for _, column := range []string{"ipv4", "ipv6", "mac"} {
+		// mysql will not update a table it is selecting from unless the select is wrapped in a derived table
+		result, err := tx.Exec("update hosts set allowduplicate = 1 where " + column + " <> '' and " + column + " in (select " + column + " from (select " + column + " from hosts group by " + column + " having count(*) > 1) as duplicates)")
+		if err != nil {
+			return err
+		}
+		if marked, _ := result.RowsAffected(); marked > 0 {
+			log.Printf("marked %d existing hosts sharing a %s as allowduplicate", marked, column)
+		}
+		// mysql has no partial indexes, so addresses are only kept unique by the checks validateHost makes
+		// when adding and updating hosts
+		if databaseType != "mysql" {
+			if _, err := tx.Exec("CREATE UNIQUE INDEX hosts_" + column + "_unique ON hosts (" + column + ") WHERE allowduplicate = 0 AND " + column + " <> ''"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateAPITokens creates the api_tokens table, only a sha256 hash of each token is stored
+func migrateAPITokens(tx *sql.Tx, databaseType string) error {
+	sqlquery := "CREATE TABLE api_tokens (name text PRIMARY KEY, tokenhash text NOT NULL UNIQUE, scopes text NOT NULL, network text NOT NULL DEFAULT '', expires text NOT NULL DEFAULT '', created text NOT NULL)"
+	if databaseType == "mysql" {
+		sqlquery = "CREATE TABLE api_tokens (name varchar(255) PRIMARY KEY, tokenhash varchar(64) NOT NULL UNIQUE, scopes varchar(255) NOT NULL, network varchar(255) NOT NULL DEFAULT '', expires varchar(64) NOT NULL DEFAULT '', created varchar(64) NOT NULL)"
+	}
+	return createTable(tx, databaseType, "api_tokens", sqlquery)
+}
+
+// migrateRegistrationKeys creates the registration_keys table. Keys are kept as they are rather than hashed
+// as signed registrations need the key to check the signature
+func migrateRegistrationKeys(tx *sql.Tx, databaseType string) error {
+	sqlquery := "CREATE TABLE registration_keys (name text PRIMARY KEY, regkey text NOT NULL UNIQUE, networks text NOT NULL, sourcecidrs text NOT NULL DEFAULT '', macprefixes text NOT NULL DEFAULT '', expires text NOT NULL DEFAULT '', maxuses integer NOT NULL DEFAULT 0, uses integer NOT NULL DEFAULT 0, created text NOT NULL)"
+	if databaseType == "mysql" {
+		sqlquery = "CREATE TABLE registration_keys (name varchar(255) PRIMARY KEY, regkey varchar(255) NOT NULL UNIQUE, networks varchar(1024) NOT NULL, sourcecidrs varchar(1024) NOT NULL DEFAULT '', macprefixes varchar(1024) NOT NULL DEFAULT '', expires varchar(64) NOT NULL DEFAULT '', maxuses integer NOT NULL DEFAULT 0, uses integer NOT NULL DEFAULT 0, created varchar(64) NOT NULL)"
+	}
+	return createTable(tx, databaseType, "registration_keys", sqlquery)
+}
+
+// migrateApproval adds the status column that holds hosts back until they are approved, and the
+// autoapprove column of networks whose registrations need no approval. Existing hosts stay active
+func migrateApproval(tx *sql.Tx, databaseType string) error {
+	sqlquery := "ALTER TABLE hosts ADD COLUMN status text NOT NULL DEFAULT 'active'"
+	if databaseType == "mysql" {
+		sqlquery = "ALTER TABLE hosts ADD COLUMN status varchar(16) NOT NULL DEFAULT 'active'"
+	}
+	if err := addColumn(tx, databaseType, "hosts", "status", sqlquery); err != nil {
+		return err
+	}
+	return addColumn(tx, databaseType, "networks", "autoapprove", "ALTER TABLE networks ADD COLUMN autoapprove integer NOT NULL DEFAULT 0")
+}
+
+// migrateAuditLog creates the audit_log table, before and after hold the json of the host or network changed
+func migrateAuditLog(tx *sql.Tx, databaseType string) error {
+	sqlquery := "CREATE TABLE audit_log (id integer PRIMARY KEY, created text NOT NULL, actor text NOT NULL, sourceip text NOT NULL DEFAULT '', action text NOT NULL, network text NOT NULL DEFAULT '', fqdn text NOT NULL DEFAULT '', beforejson text NOT NULL DEFAULT '', afterjson text NOT NULL DEFAULT '')"
+	switch databaseType {
+	case "postgres":
+		sqlquery = "CREATE TABLE audit_log (id serial PRIMARY KEY, created text NOT NULL, actor text NOT NULL, sourceip text NOT NULL DEFAULT '', action text NOT NULL, network text NOT NULL DEFAULT '', fqdn text NOT NULL DEFAULT '', beforejson text NOT NULL DEFAULT '', afterjson text NOT NULL DEFAULT '')"
+	case "mysql":
+		// mysql cannot give defaults to text columns, the json is always written so needs none
+		sqlquery = "CREATE TABLE audit_log (id integer PRIMARY KEY AUTO_INCREMENT, created varchar(64) NOT NULL, actor varchar(255) NOT NULL, sourceip varchar(45) NOT NULL DEFAULT '', action varchar(32) NOT NULL, network varchar(255) NOT NULL DEFAULT '', fqdn varchar(255) NOT NULL DEFAULT '', beforejson text NOT NULL, afterjson text NOT NULL)"
+	}
+	if err := createTable(tx, databaseType, "audit_log", sqlquery); err != nil {
+		return err
+	}
+	return createIndex(tx, databaseType, "audit_log", "audit_log_fqdn", "CREATE INDEX audit_log_fqdn ON audit_log (fqdn)")
+}
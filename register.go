@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signatureHeader carries the hmac-sha256 of a POST /register body, keyed with the RegistrationKey
+const signatureHeader = "X-Narcotk-Signature"
+
+// signedRegistration is the json body of POST /register, the host fields are the same as the Host struct
+type signedRegistration struct {
+	Host
+	KeyName   string `json:"KeyName"`
+	Upsert    bool   `json:"Upsert"`
+	Timestamp int64  `json:"Timestamp"`
+	Nonce     string `json:"Nonce"`
+}
+
+// nonceCache remembers the nonces of recent registrations so signed requests cannot be replayed
+type nonceCache struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+var registrationNonces = &nonceCache{seen: make(map[string]time.Time)}
+
+// Use records a nonce, returning false if it has already been used within the last window
+func (c *nonceCache) Use(nonce string, now time.Time, window time.Duration) bool {
+	c.Lock()
+	defer c.Unlock()
+	for seennonce, seen := range c.seen {
+		if now.Sub(seen) > window {
+			delete(c.seen, seennonce)
+		}
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = now
+	return true
+}
+
+// signRegistration returns the signature of a registration body as sent in the X-Narcotk-Signature header
+func signRegistration(body []byte, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyRegistration checks the signature, timestamp and nonce of a signed registration
+func verifyRegistration(body []byte, signature string, key string, now time.Time) (signedRegistration, error) {
+	var registration signedRegistration
+	if key == "" {
+		return registration, errors.New("no RegistrationKey is set to check signatures with")
+	}
+	if !hmac.Equal([]byte(strings.ToLower(strings.TrimSpace(signature))), []byte(signRegistration(body, key))) {
+		return registration, errors.New("invalid signature")
+	}
+	if err := json.Unmarshal(body, &registration); err != nil {
+		return registration, ValidationError{"invalid json body: " + err.Error()}
+	}
+
+	skew := time.Duration(viper.GetInt("RegistrationMaxSkew")) * time.Second
+	sent := time.Unix(registration.Timestamp, 0)
+	if sent.Before(now.Add(-skew)) || sent.After(now.Add(skew)) {
+		return registration, errors.New("timestamp is too old or too far in the future")
+	}
+	if len(registration.Nonce) < 8 || len(registration.Nonce) > 128 {
+		return registration, errors.New("nonce must be between 8 and 128 characters")
+	}
+	// a nonce only needs remembering until its timestamp can no longer pass the skew check
+	if !registrationNonces.Use(registration.Nonce, now, 2*skew) {
+		return registration, errors.New("nonce has already been used")
+	}
+	return registration, nil
+}
+
+// redactURI hides the registration key within a request uri so it is not written to logs
+func redactURI(uri string) string {
+	parsed, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return uri
+	}
+	query := parsed.Query()
+	if query.Get("key") == "" {
+		return uri
+	}
+	query.Set("key", "REDACTED")
+	parsed.RawQuery = query.Encode()
+	return parsed.RequestURI()
+}
+
+// handlerSignedRegister handles POST /register, the json body must be signed with the RegistrationKey or the
+// registration key named by KeyName, unless the request was authenticated with an api token that has the register scope
+func handlerSignedRegister(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"cannot read body: " + err.Error()})
+		return
+	}
+
+	var registration signedRegistration
+	var regkeyused *RegistrationKey
+	if _, hastoken := requestToken(r); hastoken {
+		if err := json.Unmarshal(body, &registration); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{"invalid json body: " + err.Error()})
+			return
+		}
+	} else {
+		signingkey := viper.GetString("RegistrationKey")
+		// the key name has to be read before the signature can be checked
+		var unverified signedRegistration
+		json.Unmarshal(body, &unverified)
+		if unverified.KeyName != "" {
+			key, err := store.GetRegistrationKey(unverified.KeyName)
+			if err != nil {
+				showerror("signed registration rejected", err, "warn")
+				writeJSON(w, http.StatusUnauthorized, apiError{"unknown registration key " + unverified.KeyName})
+				return
+			}
+			regkeyused, signingkey = &key, key.Key
+		}
+		registration, err = verifyRegistration(body, r.Header.Get(signatureHeader), signingkey, time.Now())
+		if _, ok := err.(ValidationError); ok {
+			writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+			return
+		}
+		if err != nil {
+			showerror("signed registration rejected", err, "warn")
+			writeJSON(w, http.StatusUnauthorized, apiError{err.Error()})
+			return
+		}
+	}
+
+	host := registration.Host
+	if (host.Hostname == "") || (host.IPv4 == "") || (host.Network == "") {
+		writeJSONError(w, ValidationError{"Hostname, IPv4 and Network are required"})
+		return
+	}
+	if !requestAllowsNetwork(r, host.Network) {
+		writeJSONError(w, errForbidden)
+		return
+	}
+	if err := checkRegistrationKey(r, regkeyused, host.Network, host.MAC); err != nil {
+		showerror("registration rejected", err, "warn")
+		writeJSONError(w, err)
+		return
+	}
+	upsert := registration.Upsert || strings.ToLower(viper.GetString("RegistrationPolicy")) == "upsert"
+	host, result, err := registerWithKey(requestAudit(r, regkeyused), regkeyused, Host{Network: host.Network, IPv4: host.IPv4, IPv6: host.IPv6, Hostname: host.Hostname, Aliases: mergeAliases(host.Aliases, host.Short1, host.Short2, host.Short3, host.Short4), MAC: host.MAC}, upsert)
+	if err != nil {
+		showerror("registration rejected", err, "warn")
+		writeJSONError(w, err)
+		return
+	}
+	log.Printf("registration of %s / %s: %s", host.Hostname, host.Network, result)
+
+	status := http.StatusOK
+	if result == registrationCreated {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, registrationResponse{Result: result, Host: host})
+}
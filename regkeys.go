@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RegistrationKey is a key devices can register with, limited to some networks and optionally to
+// source addresses and mac address prefixes. Unlike api tokens the key itself is stored so signed
+// registrations can be checked
+type RegistrationKey struct {
+	Name        string   `json:"Name"`
+	Key         string   `json:"-"`
+	Networks    []string `json:"Networks"`
+	SourceCIDRs []string `json:"SourceCIDRs"`
+	MACPrefixes []string `json:"MACPrefixes"`
+	Expires     string   `json:"Expires"`
+	MaxUses     int      `json:"MaxUses"`
+	Uses        int      `json:"Uses"`
+	Created     string   `json:"Created"`
+}
+
+// macPrefixPattern matches one to six octets of a mac address once cleaned up by PrepareMac
+var macPrefixPattern = regexp.MustCompile(`^[0-9a-f]{2}(:[0-9a-f]{2}){0,5}$`)
+
+// splitList turns a comma separated list in to a slice, dropping blank entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Allows checks that a key can register a host in to network from sourceip with mac
+func (k RegistrationKey) Allows(network string, sourceip string, mac string, now time.Time) error {
+	if expired(k.Expires, now) {
+		return ForbiddenError{"registration key " + k.Name + " expired at " + k.Expires}
+	}
+	if k.MaxUses > 0 && k.Uses >= k.MaxUses {
+		return ForbiddenError{"registration key " + k.Name + " has been used the maximum number of times"}
+	}
+
+	allowed := false
+	for _, keynetwork := range k.Networks {
+		if strings.EqualFold(keynetwork, network) {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return ForbiddenError{"registration key " + k.Name + " cannot register hosts in to network " + network}
+	}
+
+	if len(k.SourceCIDRs) > 0 {
+		allowed = false
+		for _, cidr := range k.SourceCIDRs {
+			if inside, err := IPInCIDR(sourceip, cidr); err == nil && inside {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return ForbiddenError{"registration key " + k.Name + " cannot be used from " + sourceip}
+		}
+	}
+
+	if len(k.MACPrefixes) > 0 {
+		mac = PrepareMac(mac)
+		allowed = false
+		for _, prefix := range k.MACPrefixes {
+			if mac != "" && strings.HasPrefix(mac, PrepareMac(prefix)) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return ForbiddenError{"registration key " + k.Name + " cannot register mac address " + mac}
+		}
+	}
+	return nil
+}
+
+// remoteIP returns the address a web request came from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkRegistrationKey makes sure the registration key a request used allows the registration,
+// a nil key means the global RegistrationKey or an api token was used so nothing more is checked
+func checkRegistrationKey(r *http.Request, key *RegistrationKey, network string, mac string) error {
+	if key == nil {
+		return nil
+	}
+	return key.Allows(network, remoteIP(r), mac, time.Now())
+}
+
+// registerWithKey registers a host with the registration key a request used. A use of the key is taken before
+// the host is written, so concurrent registrations cannot go over its maximum uses, and given back when the
+// registration fails or leaves the host unchanged
+func registerWithKey(audit auditContext, key *RegistrationKey, host Host, upsert bool) (Host, string, error) {
+	if key == nil {
+		return registerHost(audit, host, upsert)
+	}
+	if err := store.UseRegistrationKey(key.Name); err != nil {
+		return Host{}, "", err
+	}
+	registered, result, err := registerHost(audit, host, upsert)
+	if err != nil || result == registrationUnchanged {
+		showerror("cannot give back use of registration key "+key.Name, store.ReturnRegistrationKeyUse(key.Name), "warn")
+	}
+	return registered, result, err
+}
+
+// createRegistrationKey stores a new registration key and returns it
+func createRegistrationKey(name string, networks string, sourcecidrs string, macprefixes string, expires string, maxuses int) (RegistrationKey, error) {
+	if name == "" {
+		return RegistrationKey{}, ValidationError{"registration key name is required"}
+	}
+	key := RegistrationKey{Name: name, Networks: splitList(networks), SourceCIDRs: splitList(sourcecidrs), MaxUses: maxuses, Created: time.Now().UTC().Format(time.RFC3339)}
+	if len(key.Networks) == 0 {
+		return RegistrationKey{}, ValidationError{"at least one network is required"}
+	}
+	for _, network := range key.Networks {
+		if _, err := store.GetNetwork(network); err == ErrNotFound {
+			return RegistrationKey{}, ValidationError{"network does not exist: " + network}
+		} else if err != nil {
+			return RegistrationKey{}, err
+		}
+	}
+	for _, cidr := range key.SourceCIDRs {
+		if _, err := ParseNetworkCIDR(cidr); err != nil {
+			return RegistrationKey{}, ValidationError{"source cidr is not valid: " + cidr}
+		}
+	}
+	for _, prefix := range splitList(macprefixes) {
+		if !macPrefixPattern.MatchString(PrepareMac(prefix)) {
+			return RegistrationKey{}, ValidationError{"mac prefix is not valid: " + prefix}
+		}
+		key.MACPrefixes = append(key.MACPrefixes, PrepareMac(prefix))
+	}
+	if maxuses < 0 {
+		return RegistrationKey{}, ValidationError{"maximum uses cannot be negative"}
+	}
+	var err error
+	if key.Expires, err = parseExpiry(expires, time.Now()); err != nil {
+		return RegistrationKey{}, ValidationError{err.Error()}
+	}
+	if _, err := store.GetRegistrationKey(name); err == nil {
+		return RegistrationKey{}, ConflictError{"registration key already exists: " + name}
+	} else if err != ErrNotFound {
+		return RegistrationKey{}, err
+	}
+
+	if key.Key, err = generateToken(); err != nil {
+		return RegistrationKey{}, err
+	}
+	if err := store.CreateRegistrationKey(key); err != nil {
+		return RegistrationKey{}, err
+	}
+	return key, nil
+}
+
+// addRegistrationKey creates a registration key from the cli and prints it
+func addRegistrationKey(name string, networks string, sourcecidrs string, macprefixes string, expires string, maxuses int) error {
+	key, err := createRegistrationKey(name, networks, sourcecidrs, macprefixes, expires, maxuses)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Created registration key: " + key.Name)
+	fmt.Println("Networks:     " + strings.Join(key.Networks, ","))
+	fmt.Println("Source CIDRs: " + strings.Join(key.SourceCIDRs, ","))
+	fmt.Println("MAC Prefixes: " + strings.Join(key.MACPrefixes, ","))
+	fmt.Println("Expires:      " + key.Expires)
+	fmt.Println("Max Uses:     " + strconv.Itoa(key.MaxUses))
+	fmt.Println("Key:          " + key.Key)
+	return nil
+}
+
+// listRegistrationKeys prints the registration keys, the keys themselves are never shown
+func listRegistrationKeys(printjson bool) error {
+	mykeys, err := store.ListRegistrationKeys()
+	if err != nil {
+		return err
+	}
+	if printjson {
+		if mykeys == nil {
+			mykeys = []RegistrationKey{}
+		}
+		c, err := json.Marshal(mykeys)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", c)
+		return nil
+	}
+	now := time.Now()
+	for _, key := range mykeys {
+		uses := strconv.Itoa(key.Uses)
+		if key.MaxUses > 0 {
+			uses = uses + "/" + strconv.Itoa(key.MaxUses)
+		}
+		status := ""
+		if expired(key.Expires, now) {
+			status = "  (expired)"
+		}
+		fmt.Printf("%s  %s  %s  %s  %s  %s%s\n", key.Name, strings.Join(key.Networks, ","), strings.Join(key.SourceCIDRs, ","), strings.Join(key.MACPrefixes, ","), uses, key.Expires, status)
+	}
+	return nil
+}
+
+// delRegistrationKey revokes a registration key
+func delRegistrationKey(name string) error {
+	return store.DeleteRegistrationKey(name)
+}
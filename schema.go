@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// supportedDatabaseTypes lists the DatabaseType settings narcotk-hosts has a driver and schema for
+var supportedDatabaseTypes = []string{"sqlite3", "postgres", "mysql"}
+
+// checkDatabaseType makes sure that a DatabaseType is one that narcotk-hosts supports
+func checkDatabaseType(databaseType string) error {
+	for _, supported := range supportedDatabaseTypes {
+		if databaseType == supported {
+			return nil
+		}
+	}
+	return errors.New("unsupported database type " + databaseType + ", use one of: " + strings.Join(supportedDatabaseTypes, ", "))
+}
+
+// isFileDatabase returns true when the Database setting is a path to a local file rather than a DSN
+func isFileDatabase(databaseType string) bool {
+	return databaseType == "sqlite3"
+}
+
+// rebind converts the ? placeholders used throughout narcotk-hosts in to the style the database type expects
+func rebind(databaseType string, sqlquery string) string {
+	if databaseType != "postgres" {
+		return sqlquery
+	}
+	var buffer strings.Builder
+	quoted := false
+	n := 0
+	for _, c := range sqlquery {
+		if c == '\'' {
+			quoted = !quoted
+		}
+		if c == '?' && !quoted {
+			n++
+			buffer.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		buffer.WriteRune(c)
+	}
+	return buffer.String()
+}
+
+// hostsTableStatement returns the statement used to create a version 1 hosts table called name
+func hostsTableStatement(databaseType string, name string) string {
+	switch databaseType {
+	case "postgres":
+		return `
+  CREATE TABLE ` + name + ` (
+    network text NOT NULL,
+    ipv4 text NOT NULL DEFAULT '',
+    ipv6 text NOT NULL DEFAULT '',
+    fqdn text NOT NULL,
+    short1 text NOT NULL DEFAULT '',
+    short2 text NOT NULL DEFAULT '',
+    short3 text NOT NULL DEFAULT '',
+    short4 text NOT NULL DEFAULT '',
+    mac text NOT NULL DEFAULT '')`
+	case "mysql":
+		// mysql cannot index or give defaults to text columns, so varchar is used instead
+		return `
+  CREATE TABLE ` + name + ` (
+    network varchar(255) NOT NULL,
+    ipv4 varchar(45) NOT NULL DEFAULT '',
+    ipv6 varchar(45) NOT NULL DEFAULT '',
+    fqdn varchar(255) NOT NULL,
+    short1 varchar(255) NOT NULL DEFAULT '',
+    short2 varchar(255) NOT NULL DEFAULT '',
+    short3 varchar(255) NOT NULL DEFAULT '',
+    short4 varchar(255) NOT NULL DEFAULT '',
+    mac varchar(17) NOT NULL DEFAULT '')`
+	default:
+		return `
+  CREATE TABLE ` + name + ` (
+    network text NOT NULL,
+    ipv4 text DEFAULT '',
+    ipv6 text DEFAULT '',
+    fqdn text NOT NULL,
+    short1 text DEFAULT '',
+    short2 text DEFAULT '',
+    short3 text DEFAULT '',
+    short4 text DEFAULT '',
+    mac text DEFAULT '')`
+	}
+}
+
+// networksTableStatement returns the statement used to create a version 1 networks table
+func networksTableStatement(databaseType string) string {
+	if databaseType == "mysql" {
+		return `
+  CREATE TABLE networks (
+    network varchar(255) PRIMARY KEY,
+    cidr varchar(64) NOT NULL,
+    description varchar(255) NOT NULL DEFAULT '')`
+	}
+	return `
+  CREATE TABLE networks (
+    network text PRIMARY KEY,
+    cidr text NOT NULL,
+    description text NOT NULL DEFAULT '')`
+}
+
+// createSchema creates the version 1 tables within a blank database then migrates them to the latest version
+func createSchema(db *sql.DB, databaseType string) error {
+	for _, sqlquery := range []string{hostsTableStatement(databaseType, "hosts"), networksTableStatement(databaseType), schemaVersionStatement(databaseType)} {
+		if _, err := db.Exec(sqlquery); err != nil {
+			return err
+		}
+	}
+	if err := recordSchemaVersion(db, databaseType, 1, "new database"); err != nil {
+		return err
+	}
+	return migrateDatabase(db, databaseType)
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrNotFound is returned by a Store when the requested host or network does not exist
+var ErrNotFound = errors.New("not found")
+
+// HostFilter narrows down the hosts returned by ListHosts, blank fields match everything. NetworkLike and
+// FQDNLike are sql like patterns, where % and _ are wildcards, for the lookups that always allowed them
+type HostFilter struct {
+	Network     string
+	FQDN        string
+	IP          string
+	MAC         string
+	Status      string
+	NetworkLike string
+	FQDNLike    string
+}
+
+// NetworkFilter narrows down the networks returned by ListNetworks, blank fields match everything.
+// NetworkLike is an sql like pattern
+type NetworkFilter struct {
+	Network     string
+	NetworkLike string
+}
+
+// AuditFilter narrows down the entries returned by ListAuditEntries, blank fields match everything
+type AuditFilter struct {
+	FQDN    string
+	Network string
+}
+
+// Store is the data access layer used for reading and writing hosts and networks
+type Store interface {
+	ListHosts(filter HostFilter) ([]Host, error)
+	GetHost(fqdn string, network string) (Host, error)
+	CreateHost(host Host) error
+	UpdateHost(fqdn string, network string, host Host) error
+	DeleteHost(fqdn string, network string) error
+	FindDuplicates(host Host, excludefqdn string, excludenetwork string) ([]Host, error)
+	ListNetworks(filter NetworkFilter) ([]SingleNetwork, error)
+	GetNetwork(network string) (SingleNetwork, error)
+	CreateNetwork(network SingleNetwork) error
+	UpdateNetwork(oldnetwork string, network SingleNetwork) error
+	DeleteNetwork(network string) error
+	ListTokens() ([]APIToken, error)
+	GetTokenByHash(hash string) (APIToken, error)
+	CreateToken(token APIToken) error
+	DeleteToken(name string) error
+	ListRegistrationKeys() ([]RegistrationKey, error)
+	GetRegistrationKey(name string) (RegistrationKey, error)
+	FindRegistrationKey(key string) (RegistrationKey, error)
+	CreateRegistrationKey(key RegistrationKey) error
+	UseRegistrationKey(name string) error
+	ReturnRegistrationKeyUse(name string) error
+	DeleteRegistrationKey(name string) error
+	ListAuditEntries(filter AuditFilter) ([]AuditEntry, error)
+	CreateAuditEntry(entry AuditEntry) error
+	DeleteAuditEntries() error
+	InTransaction(fn func(txstore Store) error) error
+}
+
+// sqlStore is a Store backed by a database/sql connection, all queries are run as prepared statements
+type sqlStore struct {
+	db           *sql.DB
+	tx           *sql.Tx
+	databaseType string
+}
+
+const hostColumns = "network, ipv4, ipv6, fqdn, short1, short2, short3, short4, mac, allowduplicate, status"
+
+const networkColumns = "network, cidr, description, autoapprove"
+
+const tokenColumns = "name, tokenhash, scopes, network, expires, created"
+
+const registrationKeyColumns = "name, regkey, networks, sourcecidrs, macprefixes, expires, maxuses, uses, created"
+
+const auditColumns = "created, actor, sourceip, action, network, fqdn, beforejson, afterjson"
+
+// NewSQLStore returns a Store that uses the passed database connection and type
+func NewSQLStore(db *sql.DB, databaseType string) Store {
+	return &sqlStore{db: db, databaseType: databaseType}
+}
+
+// prepare creates a prepared statement, within the current transaction if there is one
+func (s *sqlStore) prepare(sqlquery string) (*sql.Stmt, error) {
+	if s.tx != nil {
+		return s.tx.Prepare(rebind(s.databaseType, sqlquery))
+	}
+	return s.db.Prepare(rebind(s.databaseType, sqlquery))
+}
+
+// inTx runs fn against a copy of the store bound to a transaction, which is committed if fn succeeds.
+// When already within a transaction fn joins it instead
+func (s *sqlStore) inTx(fn func(txstore *sqlStore) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(&sqlStore{db: s.db, tx: tx, databaseType: s.databaseType}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// query prepares and runs a query that returns rows
+func (s *sqlStore) query(sqlquery string, args ...interface{}) (*sql.Rows, error) {
+	// a statement prepared within a transaction is closed at once rather than when its rows are, which would
+	// leave no rows to read, so queries within a transaction are not prepared
+	if s.tx != nil {
+		return s.tx.Query(rebind(s.databaseType, sqlquery), args...)
+	}
+	stmt, err := s.prepare(sqlquery)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	return stmt.Query(args...)
+}
+
+// exec prepares and runs a query that does not return rows, returning the number of rows affected
+func (s *sqlStore) exec(sqlquery string, args ...interface{}) (int64, error) {
+	stmt, err := s.prepare(sqlquery)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	result, err := stmt.Exec(args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// matches returns a condition comparing a column to a placeholder, case-insensitively on
+// every database type rather than relying on how each backend collates like
+func matches(column string) string {
+	return "lower(" + column + ") = lower(?)"
+}
+
+// likes returns a condition matching a column against an sql like pattern held in a placeholder,
+// case-insensitively on every database type
+func likes(column string) string {
+	return "lower(" + column + ") like lower(?)"
+}
+
+// whereClause joins conditions together in to a where clause
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " where " + strings.Join(conditions, " and ")
+}
+
+func (s *sqlStore) ListHosts(filter HostFilter) ([]Host, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.Network != "" {
+		conditions = append(conditions, matches("network"))
+		args = append(args, filter.Network)
+	}
+	if filter.FQDN != "" {
+		conditions = append(conditions, matches("fqdn"))
+		args = append(args, filter.FQDN)
+	}
+	if filter.IP != "" {
+		conditions = append(conditions, "("+matches("ipv4")+" or "+matches("ipv6")+")")
+		args = append(args, filter.IP, filter.IP)
+	}
+	if filter.MAC != "" {
+		conditions = append(conditions, matches("mac"))
+		args = append(args, filter.MAC)
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, matches("status"))
+		args = append(args, filter.Status)
+	}
+	if filter.NetworkLike != "" {
+		conditions = append(conditions, likes("network"))
+		args = append(args, filter.NetworkLike)
+	}
+	if filter.FQDNLike != "" {
+		conditions = append(conditions, likes("fqdn"))
+		args = append(args, filter.FQDNLike)
+	}
+
+	rows, err := s.query("select "+hostColumns+" from hosts"+whereClause(conditions), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var myhosts []Host
+	for rows.Next() {
+		var host Host
+		err = rows.Scan(&host.Network, &host.IPv4, &host.IPv6, &host.Hostname, &host.Short1, &host.Short2, &host.Short3, &host.Short4, &host.MAC, &host.AllowDuplicate, &host.Status)
+		if err != nil {
+			return nil, err
+		}
+		host.PaddedIP = MakePaddedIp(host.IPv4)
+		myhosts = append(myhosts, host)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	aliases, err := s.listAliases()
+	if err != nil {
+		return nil, err
+	}
+	for i := range myhosts {
+		myhosts[i].Aliases = aliases[aliasKey(myhosts[i].Network, myhosts[i].Hostname)]
+		myhosts[i] = normaliseAliases(myhosts[i])
+	}
+
+	sort.Slice(myhosts, func(i, j int) bool {
+		return bytes.Compare([]byte(myhosts[i].PaddedIP), []byte(myhosts[j].PaddedIP)) < 0
+	})
+	return myhosts, nil
+}
+
+func (s *sqlStore) GetHost(fqdn string, network string) (Host, error) {
+	myhosts, err := s.ListHosts(HostFilter{Network: network, FQDN: fqdn})
+	if err != nil {
+		return Host{}, err
+	}
+	if len(myhosts) == 0 {
+		return Host{}, ErrNotFound
+	}
+	if len(myhosts) > 1 {
+		return Host{}, errors.New("more than one host found with identifier " + fqdn + " / " + network)
+	}
+	return myhosts[0], nil
+}
+
+// aliasKey identifies the host an alias belongs to
+func aliasKey(network string, fqdn string) string {
+	return strings.ToLower(network) + " " + strings.ToLower(fqdn)
+}
+
+// listAliases returns the aliases of every host in order, keyed by aliasKey
+func (s *sqlStore) listAliases() (map[string][]string, error) {
+	rows, err := s.query("select network, fqdn, alias from aliases order by aliasorder")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := make(map[string][]string)
+	for rows.Next() {
+		var network, fqdn, alias string
+		if err := rows.Scan(&network, &fqdn, &alias); err != nil {
+			return nil, err
+		}
+		aliases[aliasKey(network, fqdn)] = append(aliases[aliasKey(network, fqdn)], alias)
+	}
+	return aliases, rows.Err()
+}
+
+// setAliases replaces the aliases of a host
+func (s *sqlStore) setAliases(fqdn string, network string, aliases []string) error {
+	if _, err := s.exec("delete from aliases where "+matches("fqdn")+" and "+matches("network"), fqdn, network); err != nil {
+		return err
+	}
+	for i, alias := range aliases {
+		if _, err := s.exec("insert into aliases (network, fqdn, alias, aliasorder) values (?, ?, ?, ?)", network, fqdn, alias, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) CreateHost(host Host) error {
+	host = normaliseAliases(host)
+	if host.Status == "" {
+		host.Status = hostActive
+	}
+	return s.inTx(func(txstore *sqlStore) error {
+		_, err := txstore.exec("insert into hosts ("+hostColumns+") values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			host.Network, host.IPv4, host.IPv6, host.Hostname, host.Short1, host.Short2, host.Short3, host.Short4, host.MAC, boolToInt(host.AllowDuplicate), host.Status)
+		if err != nil {
+			return err
+		}
+		return txstore.setAliases(host.Hostname, host.Network, host.Aliases)
+	})
+}
+
+func (s *sqlStore) UpdateHost(fqdn string, network string, host Host) error {
+	host = normaliseAliases(host)
+	return s.inTx(func(txstore *sqlStore) error {
+		if err := txstore.updateHostRow(fqdn, network, host); err != nil {
+			return err
+		}
+		if err := txstore.setAliases(fqdn, network, nil); err != nil {
+			return err
+		}
+		return txstore.setAliases(host.Hostname, host.Network, host.Aliases)
+	})
+}
+
+// updateHostRow updates the hosts table entry for a host
+func (s *sqlStore) updateHostRow(fqdn string, network string, host Host) error {
+	affected, err := s.exec("update hosts set network = ?, ipv4 = ?, ipv6 = ?, fqdn = ?, short1 = ?, short2 = ?, short3 = ?, short4 = ?, mac = ?, allowduplicate = ?, status = ? where "+matches("fqdn")+" and "+matches("network"),
+		host.Network, host.IPv4, host.IPv6, host.Hostname, host.Short1, host.Short2, host.Short3, host.Short4, host.MAC, boolToInt(host.AllowDuplicate), host.Status, fqdn, network)
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		// mysql reports rows changed rather than rows matched, so check the host really is missing
+		_, err = s.GetHost(fqdn, network)
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteHost(fqdn string, network string) error {
+	return s.inTx(func(txstore *sqlStore) error {
+		affected, err := txstore.exec("delete from hosts where "+matches("fqdn")+" and "+matches("network"), fqdn, network)
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return ErrNotFound
+		}
+		return txstore.setAliases(fqdn, network, nil)
+	})
+}
+
+// boolToInt converts a bool for storing in an integer column, as not every driver does so itself
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (s *sqlStore) FindDuplicates(host Host, excludefqdn string, excludenetwork string) ([]Host, error) {
+	var clashes []string
+	var args []interface{}
+	for _, column := range []struct{ name, value string }{{"ipv4", host.IPv4}, {"ipv6", host.IPv6}, {"mac", host.MAC}} {
+		if column.value != "" {
+			clashes = append(clashes, matches(column.name))
+			args = append(args, column.value)
+		}
+	}
+	if len(clashes) == 0 {
+		return nil, nil
+	}
+
+	conditions := []string{"(" + strings.Join(clashes, " or ") + ")"}
+	if excludefqdn != "" {
+		conditions = append(conditions, "not ("+matches("fqdn")+" and "+matches("network")+")")
+		args = append(args, excludefqdn, excludenetwork)
+	}
+
+	rows, err := s.query("select network, fqdn from hosts"+whereClause(conditions), args...)
+	if err != nil {
+		return nil, err
+	}
+	var keys []Host
+	for rows.Next() {
+		var key Host
+		if err := rows.Scan(&key.Network, &key.Hostname); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+
+	var duplicates []Host
+	for _, key := range keys {
+		duplicate, err := s.GetHost(key.Hostname, key.Network)
+		if err != nil {
+			return nil, err
+		}
+		duplicates = append(duplicates, duplicate)
+	}
+	return duplicates, nil
+}
+
+func (s *sqlStore) ListNetworks(filter NetworkFilter) ([]SingleNetwork, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.Network != "" {
+		conditions = append(conditions, matches("network"))
+		args = append(args, filter.Network)
+	}
+	if filter.NetworkLike != "" {
+		conditions = append(conditions, likes("network"))
+		args = append(args, filter.NetworkLike)
+	}
+
+	rows, err := s.query("select "+networkColumns+" from networks"+whereClause(conditions), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mynetworks []SingleNetwork
+	for rows.Next() {
+		var network SingleNetwork
+		err = rows.Scan(&network.Network, &network.CIDR, &network.Description, &network.AutoApprove)
+		if err != nil {
+			return nil, err
+		}
+		network.PaddedNetwork = MakePaddedIp(network.Network)
+		mynetworks = append(mynetworks, network)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(mynetworks, func(i, j int) bool {
+		return bytes.Compare([]byte(mynetworks[i].PaddedNetwork), []byte(mynetworks[j].PaddedNetwork)) < 0
+	})
+	return mynetworks, nil
+}
+
+func (s *sqlStore) GetNetwork(network string) (SingleNetwork, error) {
+	mynetworks, err := s.ListNetworks(NetworkFilter{Network: network})
+	if err != nil {
+		return SingleNetwork{}, err
+	}
+	if len(mynetworks) == 0 {
+		return SingleNetwork{}, ErrNotFound
+	}
+	if len(mynetworks) > 1 {
+		return SingleNetwork{}, errors.New("more than one network found with identifier " + network)
+	}
+	return mynetworks[0], nil
+}
+
+func (s *sqlStore) CreateNetwork(network SingleNetwork) error {
+	_, err := s.exec("insert into networks ("+networkColumns+") values (?, ?, ?, ?)", network.Network, network.CIDR, network.Description, boolToInt(network.AutoApprove))
+	return err
+}
+
+// UpdateNetwork updates a network, hosts and aliases within it are moved along when the network is renamed
+func (s *sqlStore) UpdateNetwork(oldnetwork string, network SingleNetwork) error {
+	return s.inTx(func(txstore *sqlStore) error {
+		affected, err := txstore.exec("update networks set network = ?, cidr = ?, description = ?, autoapprove = ? where "+matches("network"), network.Network, network.CIDR, network.Description, boolToInt(network.AutoApprove), oldnetwork)
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			// mysql reports rows changed rather than rows matched, so check the network really is missing
+			if _, err = txstore.GetNetwork(oldnetwork); err != nil {
+				return err
+			}
+		}
+		if network.Network == oldnetwork {
+			return nil
+		}
+		if _, err := txstore.exec("update hosts set network = ? where "+matches("network"), network.Network, oldnetwork); err != nil {
+			return err
+		}
+		_, err = txstore.exec("update aliases set network = ? where "+matches("network"), network.Network, oldnetwork)
+		return err
+	})
+}
+
+func (s *sqlStore) DeleteNetwork(network string) error {
+	affected, err := s.exec("delete from networks where "+matches("network"), network)
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// listTokens returns the api tokens matching the passed conditions, sorted by name
+func (s *sqlStore) listTokens(conditions []string, args ...interface{}) ([]APIToken, error) {
+	rows, err := s.query("select "+tokenColumns+" from api_tokens"+whereClause(conditions)+" order by name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mytokens []APIToken
+	for rows.Next() {
+		var token APIToken
+		var scopes string
+		if err := rows.Scan(&token.Name, &token.Hash, &scopes, &token.Network, &token.Expires, &token.Created); err != nil {
+			return nil, err
+		}
+		token.Scopes = splitScopes(scopes)
+		mytokens = append(mytokens, token)
+	}
+	return mytokens, rows.Err()
+}
+
+func (s *sqlStore) ListTokens() ([]APIToken, error) {
+	return s.listTokens(nil)
+}
+
+func (s *sqlStore) GetTokenByHash(hash string) (APIToken, error) {
+	mytokens, err := s.listTokens([]string{"tokenhash = ?"}, hash)
+	if err != nil {
+		return APIToken{}, err
+	}
+	if len(mytokens) == 0 {
+		return APIToken{}, ErrNotFound
+	}
+	return mytokens[0], nil
+}
+
+func (s *sqlStore) CreateToken(token APIToken) error {
+	_, err := s.exec("insert into api_tokens ("+tokenColumns+") values (?, ?, ?, ?, ?, ?)",
+		token.Name, token.Hash, strings.Join(token.Scopes, ","), token.Network, token.Expires, token.Created)
+	return err
+}
+
+func (s *sqlStore) DeleteToken(name string) error {
+	affected, err := s.exec("delete from api_tokens where "+matches("name"), name)
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// listRegistrationKeys returns the registration keys matching the passed conditions, sorted by name
+func (s *sqlStore) listRegistrationKeys(conditions []string, args ...interface{}) ([]RegistrationKey, error) {
+	rows, err := s.query("select "+registrationKeyColumns+" from registration_keys"+whereClause(conditions)+" order by name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mykeys []RegistrationKey
+	for rows.Next() {
+		var key RegistrationKey
+		var networks, sourcecidrs, macprefixes string
+		if err := rows.Scan(&key.Name, &key.Key, &networks, &sourcecidrs, &macprefixes, &key.Expires, &key.MaxUses, &key.Uses, &key.Created); err != nil {
+			return nil, err
+		}
+		key.Networks, key.SourceCIDRs, key.MACPrefixes = splitList(networks), splitList(sourcecidrs), splitList(macprefixes)
+		mykeys = append(mykeys, key)
+	}
+	return mykeys, rows.Err()
+}
+
+func (s *sqlStore) ListRegistrationKeys() ([]RegistrationKey, error) {
+	return s.listRegistrationKeys(nil)
+}
+
+func (s *sqlStore) GetRegistrationKey(name string) (RegistrationKey, error) {
+	mykeys, err := s.listRegistrationKeys([]string{matches("name")}, name)
+	if err != nil {
+		return RegistrationKey{}, err
+	}
+	if len(mykeys) == 0 {
+		return RegistrationKey{}, ErrNotFound
+	}
+	return mykeys[0], nil
+}
+
+func (s *sqlStore) FindRegistrationKey(key string) (RegistrationKey, error) {
+	mykeys, err := s.listRegistrationKeys([]string{"regkey = ?"}, key)
+	if err != nil {
+		return RegistrationKey{}, err
+	}
+	if len(mykeys) == 0 {
+		return RegistrationKey{}, ErrNotFound
+	}
+	return mykeys[0], nil
+}
+
+func (s *sqlStore) CreateRegistrationKey(key RegistrationKey) error {
+	_, err := s.exec("insert into registration_keys ("+registrationKeyColumns+") values (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		key.Name, key.Key, strings.Join(key.Networks, ","), strings.Join(key.SourceCIDRs, ","), strings.Join(key.MACPrefixes, ","), key.Expires, key.MaxUses, key.Uses, key.Created)
+	return err
+}
+
+// UseRegistrationKey counts a use of a registration key, keys that have reached their maximum uses are refused
+func (s *sqlStore) UseRegistrationKey(name string) error {
+	affected, err := s.exec("update registration_keys set uses = uses + 1 where "+matches("name")+" and (maxuses = 0 or uses < maxuses)", name)
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		if _, err := s.GetRegistrationKey(name); err != nil {
+			return err
+		}
+		return ForbiddenError{"registration key " + name + " has been used the maximum number of times"}
+	}
+	return nil
+}
+
+// ReturnRegistrationKeyUse gives back a use of a registration key taken by a registration that made no change
+func (s *sqlStore) ReturnRegistrationKeyUse(name string) error {
+	_, err := s.exec("update registration_keys set uses = uses - 1 where "+matches("name")+" and uses > 0", name)
+	return err
+}
+
+func (s *sqlStore) DeleteRegistrationKey(name string) error {
+	affected, err := s.exec("delete from registration_keys where "+matches("name"), name)
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListAuditEntries returns the audit log entries matching the filter, newest first. Entries restored from a dump
+// are ordered by when they were made rather than when they were restored
+func (s *sqlStore) ListAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.FQDN != "" {
+		conditions = append(conditions, matches("fqdn"))
+		args = append(args, filter.FQDN)
+	}
+	if filter.Network != "" {
+		conditions = append(conditions, matches("network"))
+		args = append(args, filter.Network)
+	}
+
+	rows, err := s.query("select id, "+auditColumns+" from audit_log"+whereClause(conditions)+" order by created desc, id desc", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		var before, after string
+		if err := rows.Scan(&entry.ID, &entry.Time, &entry.Actor, &entry.SourceIP, &entry.Action, &entry.Network, &entry.Hostname, &before, &after); err != nil {
+			return nil, err
+		}
+		if before != "" {
+			entry.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			entry.After = json.RawMessage(after)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqlStore) CreateAuditEntry(entry AuditEntry) error {
+	_, err := s.exec("insert into audit_log ("+auditColumns+") values (?, ?, ?, ?, ?, ?, ?, ?)",
+		entry.Time, entry.Actor, entry.SourceIP, entry.Action, entry.Network, entry.Hostname, string(entry.Before), string(entry.After))
+	return err
+}
+
+// DeleteAuditEntries empties the audit log, used when a dump replaces the database
+func (s *sqlStore) DeleteAuditEntries() error {
+	_, err := s.exec("delete from audit_log")
+	return err
+}
+
+// InTransaction runs fn against a store bound to a transaction, which is committed if fn succeeds and
+// rolled back otherwise
+func (s *sqlStore) InTransaction(fn func(txstore Store) error) error {
+	return s.inTx(func(txstore *sqlStore) error {
+		return fn(txstore)
+	})
+}
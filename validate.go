@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// ValidationError is returned when the details of a host or network are invalid
+type ValidationError struct {
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.Message
+}
+
+// ConflictError is returned when a host or network clashes with one that already exists
+type ConflictError struct {
+	Message string
+}
+
+func (e ConflictError) Error() string {
+	return e.Message
+}
+
+// ForbiddenError is returned when the caller is not allowed to change a host or network
+type ForbiddenError struct {
+	Message string
+}
+
+func (e ForbiddenError) Error() string {
+	return e.Message
+}
+
+// sameHost returns true when two fqdn and network pairs refer to the same host
+func sameHost(fqdn1 string, network1 string, fqdn2 string, network2 string) bool {
+	return strings.EqualFold(fqdn1, fqdn2) && strings.EqualFold(network1, network2)
+}
+
+// validateHost checks a host before it is added or, when original is passed, before original is updated to it.
+// The ipv6 and mac are only checked when they change so hosts with legacy data can still be updated
+func validateHost(host Host, original *Host) error {
+	if host.Hostname == "" {
+		return ValidationError{"fqdn is required"}
+	}
+	if host.Network == "" {
+		return ValidationError{"network is required"}
+	}
+	if host.Status != hostActive && host.Status != hostPending {
+		return ValidationError{"status must be " + hostActive + " or " + hostPending + ": " + host.Status}
+	}
+	if !ValidIP(host.IPv4) || net.ParseIP(host.IPv4).To4() == nil {
+		return ValidationError{"ipv4 address is not valid: " + host.IPv4}
+	}
+	if host.IPv6 != "" && (original == nil || host.IPv6 != original.IPv6) && net.ParseIP(host.IPv6) == nil {
+		return ValidationError{"ipv6 address is not valid: " + host.IPv6}
+	}
+	if host.MAC != "" && (original == nil || host.MAC != original.MAC) {
+		if _, err := net.ParseMAC(host.MAC); err != nil {
+			return ValidationError{"mac address is not valid: " + host.MAC}
+		}
+	}
+
+	if _, err := store.GetNetwork(host.Network); err != nil {
+		if err == ErrNotFound {
+			return ValidationError{"network does not exist: " + host.Network}
+		}
+		return err
+	}
+	if err := checkHostInNetwork(host.IPv4, host.Network); err != nil {
+		return ValidationError{err.Error()}
+	}
+
+	var excludefqdn, excludenetwork string
+	if original != nil {
+		excludefqdn, excludenetwork = original.Hostname, original.Network
+	}
+	if original == nil || !sameHost(host.Hostname, host.Network, original.Hostname, original.Network) {
+		if _, err := store.GetHost(host.Hostname, host.Network); err == nil {
+			return ConflictError{"host already exists: " + host.Hostname + " / " + host.Network}
+		} else if err != ErrNotFound {
+			return err
+		}
+	}
+	return checkDuplicates(host, excludefqdn, excludenetwork)
+}
+
+// validateNetwork checks a network before it is added or, when original is passed, before original is updated to it
+func validateNetwork(network SingleNetwork, original *SingleNetwork) error {
+	if network.Network == "" {
+		return ValidationError{"network is required"}
+	}
+	if _, err := ParseNetworkCIDR(network.CIDR); err != nil {
+		return ValidationError{"cidr is not valid: " + network.CIDR}
+	}
+	if original == nil || !strings.EqualFold(network.Network, original.Network) {
+		if _, err := store.GetNetwork(network.Network); err == nil {
+			return ConflictError{"network already exists: " + network.Network}
+		} else if err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
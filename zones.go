@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zoneRecords holds the records of each zone written by --exportzones, keyed by the zone's origin
+type zoneRecords map[string][]dns.RR
+
+// ensure makes sure a zone is written even when it has no records
+func (zones zoneRecords) ensure(origin string) {
+	if _, ok := zones[origin]; !ok {
+		zones[origin] = nil
+	}
+}
+
+// add files a record under the longest zone it is within, returning false if it is not within any of them
+func (zones zoneRecords) add(rr dns.RR) bool {
+	best := ""
+	for origin := range zones {
+		if dns.IsSubDomain(origin, rr.Header().Name) && len(origin) > len(best) {
+			best = origin
+		}
+	}
+	if best == "" {
+		return false
+	}
+	for _, existing := range zones[best] {
+		if existing.String() == rr.String() {
+			return true
+		}
+	}
+	zones[best] = append(zones[best], rr)
+	return true
+}
+
+// reverseZoneName returns the reverse zone of the first bits of an address, bits must fall on an octet
+// boundary for ipv4 and a nibble boundary for ipv6
+func reverseZoneName(ip net.IP, bits int) string {
+	name, _ := dns.ReverseAddr(ip.String())
+	labels := dns.SplitDomainName(name)
+	if ip.To4() != nil {
+		return dns.Fqdn(strings.Join(labels[4-bits/8:], "."))
+	}
+	return dns.Fqdn(strings.Join(labels[32-bits/4:], "."))
+}
+
+// reverseZonesForCIDR returns the reverse zones covering a network. Prefixes between boundaries are split
+// in to several zones, and ipv4 networks smaller than a /24 use the /24 they are within
+func reverseZonesForCIDR(cidr string) ([]string, error) {
+	ipnet, err := ParseNetworkCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	prefix, size := ipnet.Mask.Size()
+	step, limit := 8, 24
+	if size == 128 {
+		step, limit = 4, 124
+	}
+	zonebits := (prefix + step - 1) / step * step
+	if zonebits > limit {
+		zonebits = limit
+	}
+	if zonebits < step {
+		zonebits = step
+	}
+
+	count := 1
+	if zonebits > prefix {
+		count = 1 << uint(zonebits-prefix)
+	}
+	var zones []string
+	start := new(big.Int).SetBytes(ipnet.IP.Mask(net.CIDRMask(zonebits, size)))
+	increment := new(big.Int).Lsh(big.NewInt(1), uint(size-zonebits))
+	for i := 0; i < count; i++ {
+		current := new(big.Int).Add(start, new(big.Int).Mul(increment, big.NewInt(int64(i)))).Bytes()
+		address := make(net.IP, size/8)
+		copy(address[len(address)-len(current):], current)
+		zones = append(zones, reverseZoneName(address, zonebits))
+	}
+	return zones, nil
+}
+
+// forwardZoneName returns the forward zone a name belongs in, the DNSZone when the name is within it
+// or otherwise the domain the name is within
+func forwardZoneName(name string) string {
+	if apex := strings.ToLower(dns.Fqdn(viper.GetString("DNSZone"))); apex != "." && dns.IsSubDomain(apex, name) {
+		return apex
+	}
+	return parentDomain(name)
+}
+
+// zoneRecordLess orders records by name, and reverse records by their address
+func zoneRecordLess(a dns.RR, b dns.RR) bool {
+	ipa, ipb := reverseIP(a.Header().Name), reverseIP(b.Header().Name)
+	if ipa != nil && ipb != nil {
+		return bytes.Compare(ipa.To16(), ipb.To16()) < 0
+	}
+	return a.Header().Name < b.Header().Name
+}
+
+// buildZones works out the forward zone of each domain and the reverse zones of each network, and the
+// records within them. Hosts whose addresses are not within a network's reverse zones get a reverse zone
+// of the /24 or /64 they are within
+func buildZones(myhosts []Host, mynetworks []SingleNetwork) (zoneRecords, error) {
+	settings := dnsZone{TTL: uint32(viper.GetInt("DNSTTL")), AliasMode: strings.ToLower(viper.GetString("DNSAliases"))}
+	apex := strings.ToLower(dns.Fqdn(viper.GetString("DNSZone")))
+
+	zones := make(zoneRecords)
+	for _, network := range mynetworks {
+		origins, err := reverseZonesForCIDR(network.CIDR)
+		if err != nil {
+			showerror("cannot work out reverse zones of network "+network.Network, err, "warn")
+			continue
+		}
+		for _, origin := range origins {
+			zones.ensure(origin)
+		}
+	}
+
+	var exported []Host
+	hostnames := make(map[string]bool)
+	for _, host := range myhosts {
+		if !strings.Contains(host.Hostname, ".") && apex == "." {
+			showerror("set DNSZone to export hosts without a domain", errors.New(host.Hostname), "warn")
+			continue
+		}
+		exported = append(exported, host)
+		hostnames[qualifyName(host.Hostname, apex)] = true
+	}
+
+	var forward, reverse []dns.RR
+	cnames := make(map[string]string)
+	for _, host := range exported {
+		fqdn := qualifyName(host.Hostname, apex)
+		zones.ensure(forwardZoneName(fqdn))
+		forward = append(forward, settings.addressRecords(fqdn, host, dns.TypeANY)...)
+		for _, alias := range host.Aliases {
+			name := qualifyName(alias, parentDomain(fqdn))
+			// a cname cannot sit alongside other records, so aliases that are also host names are left out
+			if hostnames[name] {
+				continue
+			}
+			zones.ensure(forwardZoneName(name))
+			if settings.AliasMode == "a" {
+				forward = append(forward, settings.addressRecords(name, host, dns.TypeANY)...)
+				continue
+			}
+			if target, ok := cnames[name]; ok {
+				if target != fqdn {
+					showerror("alias "+name+" already points at "+target+", skipping", errors.New(fqdn), "warn")
+				}
+				continue
+			}
+			cnames[name] = fqdn
+			forward = append(forward, &dns.CNAME{Hdr: settings.header(name, dns.TypeCNAME), Target: fqdn})
+		}
+
+		for _, address := range []string{host.IPv4, host.IPv6} {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				continue
+			}
+			ptrname, _ := dns.ReverseAddr(ip.String())
+			reverse = append(reverse, &dns.PTR{Hdr: settings.header(ptrname, dns.TypePTR), Ptr: fqdn})
+		}
+	}
+
+	for _, rr := range forward {
+		zones.add(rr)
+	}
+	for _, rr := range reverse {
+		if !zones.add(rr) {
+			ip := reverseIP(rr.Header().Name)
+			bits := 64
+			if ip.To4() != nil {
+				bits = 24
+			}
+			zones.ensure(reverseZoneName(ip, bits))
+			zones.add(rr)
+		}
+	}
+	return zones, nil
+}
+
+// renderZone returns the text of a zone file
+func renderZone(zone dnsZone, records []dns.RR) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "; %s generated by narcotk-hosts, changes will be overwritten\n", zone.Origin)
+	fmt.Fprintf(&b, "$ORIGIN %s\n$TTL %d\n", zone.Origin, zone.TTL)
+	fmt.Fprintf(&b, "%s\n", zone.soa())
+	fmt.Fprintf(&b, "%s\n", &dns.NS{Hdr: zone.header(zone.Origin, dns.TypeNS), Ns: zone.Nameserver})
+	for _, rr := range records {
+		fmt.Fprintf(&b, "%s\n", rr)
+	}
+	return b.String()
+}
+
+// zoneFileSerial returns the soa serial of an existing zone file, or 0 if there is none
+func zoneFileSerial(content string) uint32 {
+	for _, line := range strings.Split(content, "\n") {
+		if rr, err := dns.NewRR(line); err == nil && rr != nil {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return soa.Serial
+			}
+		}
+	}
+	return 0
+}
+
+// nextSerial returns the serial following serial in the YYYYMMDDnn format
+func nextSerial(serial uint32, now time.Time) uint32 {
+	today, _ := strconv.ParseUint(now.Format("20060102")+"00", 10, 32)
+	if uint32(today) > serial {
+		return uint32(today)
+	}
+	return serial + 1
+}
+
+// writeFileAtomic replaces a file by writing a temporary file alongside it then renaming it in to place
+func writeFileAtomic(filename string, content []byte, perm os.FileMode) error {
+	temp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := os.Chmod(temp.Name(), perm); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), filename)
+}
+
+// writeZone writes a zone file in to directory, the file is only rewritten with a new serial when its records change.
+// It returns the serial of the zone and whether the file was written
+func writeZone(directory string, origin string, records []dns.RR, now time.Time) (uint32, bool, error) {
+	zone, err := dnsZoneSettings(origin)
+	if err != nil {
+		return 0, false, err
+	}
+	filename := filepath.Join(directory, "db."+strings.TrimSuffix(origin, "."))
+	existing, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, false, err
+	}
+
+	zone.Serial = zoneFileSerial(string(existing))
+	if len(existing) > 0 && renderZone(zone, records) == string(existing) {
+		return zone.Serial, false, nil
+	}
+	zone.Serial = nextSerial(zone.Serial, now)
+	return zone.Serial, true, writeFileAtomic(filename, []byte(renderZone(zone, records)), 0644)
+}
+
+// exportZones writes a zone file for each forward and reverse zone in to directory, along with
+// named.conf and nsd.conf snippets that load them
+func exportZones(directory string) error {
+	myhosts, err := store.ListHosts(HostFilter{Status: hostActive})
+	if err != nil {
+		return err
+	}
+	mynetworks, err := store.ListNetworks(NetworkFilter{})
+	if err != nil {
+		return err
+	}
+	zones, err := buildZones(myhosts, mynetworks)
+	if err != nil {
+		return ValidationError{err.Error()}
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	absolute, err := filepath.Abs(directory)
+	if err != nil {
+		return err
+	}
+
+	var origins []string
+	for origin := range zones {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	var bind, nsd bytes.Buffer
+	now := time.Now()
+	for _, origin := range origins {
+		records := zones[origin]
+		sort.SliceStable(records, func(i, j int) bool {
+			return zoneRecordLess(records[i], records[j])
+		})
+		serial, written, err := writeZone(directory, origin, records, now)
+		if err != nil {
+			return errors.New("cannot write zone " + origin + ": " + err.Error())
+		}
+		result := "UNCHANGED"
+		if written {
+			result = "UPDATED"
+		}
+		fmt.Printf("%-9s  %-30s  serial %d  %d records\n", result, strings.TrimSuffix(origin, "."), serial, len(records))
+
+		zonefile := filepath.Join(absolute, "db."+strings.TrimSuffix(origin, "."))
+		fmt.Fprintf(&bind, "zone \"%s\" {\n\ttype master;\n\tfile \"%s\";\n};\n\n", strings.TrimSuffix(origin, "."), zonefile)
+		fmt.Fprintf(&nsd, "zone:\n\tname: \"%s\"\n\tzonefile: \"%s\"\n\n", strings.TrimSuffix(origin, "."), zonefile)
+	}
+	if err := writeFileAtomic(filepath.Join(directory, "named.conf.narcotk"), bind.Bytes(), 0644); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(directory, "nsd.conf.narcotk"), nsd.Bytes(), 0644)
+}